@@ -4,18 +4,15 @@ go 1.19
 
 require (
 	encore.dev v1.5.0
+	github.com/authorizerdev/authorizer-go v0.0.0-20220918084423-0b0209e2234e
 	github.com/samber/lo v1.27.0
 	github.com/stretchr/testify v1.7.1
 )
 
 require (
-	github.com/PuerkitoBio/goquery v1.8.0 // indirect
-	github.com/andybalholm/cascadia v1.3.1 // indirect
-	github.com/authorizerdev/authorizer-go v0.0.0-20220918084423-0b0209e2234e // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/mitchellh/mapstructure v1.5.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/stretchr/objx v0.1.0 // indirect
 	golang.org/x/exp v0.0.0-20220303212507-bbda1eaf7a17 // indirect
-	golang.org/x/net v0.0.0-20210916014120-12bc252f5db8 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,109 @@
+package marktplaats
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"encore.dev/beta/errs"
+)
+
+// Attribute is a property listings can be filtered on, for example their condition.
+type Attribute struct {
+	// Key identifies the attribute, for example condition or offeredSince.
+	Key   string
+	Label string
+	// SingleSelect means that only one of the values can be selected.
+	SingleSelect bool
+	Values       []AttributeOption
+}
+
+// AttributeOption is a value of an attribute.
+type AttributeOption struct {
+	// ID selects the value with QueryRequest.AttributesByID. It is zero for
+	// values that are selected by key with QueryRequest.AttributesByKey.
+	ID    int `json:",omitempty"`
+	Key   string
+	Label string
+	// Count is the number of listings with the value, when marktplaats reports it.
+	Count   int  `json:",omitempty"`
+	Default bool `json:",omitempty"`
+}
+
+// Attributes retrieves the attributes listings in the category can be
+// filtered on, with the number of listings for every value.
+func (c *Client) Attributes(ctx context.Context, category, subCategory int) ([]Attribute, error) {
+	url, err := QueryRequest{Category: category, SubCategory: subCategory, Limit: 1}.url(c.baseURL + searchPath)
+	if err != nil {
+		return nil, errs.Wrap(err, "could not get marktplaats query url")
+	}
+	res, err := c.fetch(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	var attributes []Attribute
+	for _, f := range res.Facets {
+		if f.Type != "AttributeGroupFacet" {
+			continue
+		}
+		a := Attribute{Key: f.Key, Label: f.Label, SingleSelect: f.SingleSelect}
+		for _, v := range f.AttributeGroup {
+			label := v.AttributeValueLabel
+			if label == "" {
+				label = v.AttributeValueKey
+			}
+			a.Values = append(a.Values, AttributeOption{
+				ID:      v.AttributeValueId,
+				Key:     v.AttributeValueKey,
+				Label:   label,
+				Count:   v.HistogramCount,
+				Default: v.Default,
+			})
+		}
+		attributes = append(attributes, a)
+	}
+	if offeredSince := res.AttributeHierarchy.OfferedSince; len(offeredSince) > 0 {
+		a := Attribute{Key: offeredSinceAttribute, Label: offeredSince[0].AttributeLabel, SingleSelect: true}
+		for _, v := range offeredSince {
+			a.Values = append(a.Values, AttributeOption{Key: v.AttributeValueKey, Label: v.AttributeValueKey, Default: v.IsDefault})
+		}
+		attributes = append(attributes, a)
+	}
+	return attributes, nil
+}
+
+// offeredSinceAttribute is the key of the attribute selecting listings by their age.
+const offeredSinceAttribute = "offeredSince"
+
+// ResolveAttribute looks up the attribute with the key, ignoring case, and its
+// value. Values match on their key or label, ignoring case, and spaces may be
+// written as dashes: condition=zo-goed-als-nieuw.
+func ResolveAttribute(attributes []Attribute, key, value string) (Attribute, AttributeOption, error) {
+	invalid := func(format string, args ...interface{}) error {
+		return &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf(format, args...)}
+	}
+	for _, a := range attributes {
+		if !strings.EqualFold(a.Key, key) {
+			continue
+		}
+		for _, v := range a.Values {
+			if sameAttributeValue(v.Key, value) || sameAttributeValue(v.Label, value) {
+				return a, v, nil
+			}
+		}
+		keys := make([]string, 0, len(a.Values))
+		for _, v := range a.Values {
+			keys = append(keys, v.Key)
+		}
+		return Attribute{}, AttributeOption{}, invalid("unknown value %q for attribute %s, expected one of %s", value, key, strings.Join(keys, ", "))
+	}
+	return Attribute{}, AttributeOption{}, invalid("unknown attribute %q", key)
+}
+
+func sameAttributeValue(a, b string) bool {
+	normalize := func(s string) string {
+		return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(s)), " ", "-")
+	}
+	return normalize(a) == normalize(b)
+}
@@ -0,0 +1,142 @@
+package marktplaats
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"encore.dev/beta/errs"
+)
+
+// Category is a marktplaats category. Top level (L1) categories have no
+// parent, their subcategories (L2) have the top level category as parent.
+type Category struct {
+	ID int
+	// Key is the slug of the category in marktplaats URLs, for example kachels.
+	Key      string
+	Name     string
+	FullName string
+	ParentID int `json:",omitempty"`
+}
+
+// Taxonomy looks up marktplaats categories by their slugs.
+type Taxonomy struct {
+	categories []Category
+	byID       map[int]Category
+	// byKey maps a parent id and key to the category, top level categories have parent 0.
+	byKey map[categoryKey]Category
+}
+
+type categoryKey struct {
+	parentID int
+	key      string
+}
+
+// NewTaxonomy creates a taxonomy of the categories.
+func NewTaxonomy(categories []Category) *Taxonomy {
+	t := &Taxonomy{
+		categories: append([]Category(nil), categories...),
+		byID:       map[int]Category{},
+		byKey:      map[categoryKey]Category{},
+	}
+	sort.Slice(t.categories, func(i, j int) bool {
+		return t.categories[i].ID < t.categories[j].ID
+	})
+	for _, c := range t.categories {
+		t.byID[c.ID] = c
+		t.byKey[categoryKey{c.ParentID, c.Key}] = c
+	}
+	return t
+}
+
+//go:embed categories.json
+var snapshot []byte
+
+// SnapshotTaxonomy returns a recorded subset of the marktplaats categories. It
+// is used in tests, and when the categories can't be retrieved from marktplaats.
+func SnapshotTaxonomy() *Taxonomy {
+	var categories []Category
+	if err := json.Unmarshal(snapshot, &categories); err != nil {
+		panic(err)
+	}
+	return NewTaxonomy(categories)
+}
+
+// Categories returns all categories ordered by id.
+func (t *Taxonomy) Categories() []Category {
+	return append([]Category(nil), t.categories...)
+}
+
+// Category returns the category with the id.
+func (t *Taxonomy) Category(id int) (Category, bool) {
+	c, ok := t.byID[id]
+	return c, ok
+}
+
+// Resolve returns the top level category with the key, and its subcategory
+// with the subKey if set. An unknown key is an error, searching with it would
+// silently search all categories.
+func (t *Taxonomy) Resolve(key, subKey string) (category Category, sub Category, err error) {
+	category, ok := t.byKey[categoryKey{0, key}]
+	if !ok {
+		return Category{}, Category{}, &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("unknown category %q", key)}
+	}
+	if subKey == "" {
+		return category, Category{}, nil
+	}
+	sub, ok = t.byKey[categoryKey{category.ID, subKey}]
+	if !ok {
+		return Category{}, Category{}, &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("unknown category %q in %q", subKey, key)}
+	}
+	return category, sub, nil
+}
+
+// Categories retrieves the top level categories and their subcategories from
+// the search API. It makes a search request for every top level category.
+func (c *Client) Categories(ctx context.Context) ([]Category, error) {
+	found := map[int]Category{}
+	if err := c.searchCategories(ctx, 0, found); err != nil {
+		return nil, err
+	}
+	var top []int
+	for id, category := range found {
+		if category.ParentID == 0 {
+			top = append(top, id)
+		}
+	}
+	for _, id := range top {
+		if err := c.searchCategories(ctx, id, found); err != nil {
+			return nil, err
+		}
+	}
+	categories := make([]Category, 0, len(found))
+	for _, category := range found {
+		categories = append(categories, category)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		return categories[i].ID < categories[j].ID
+	})
+	return categories, nil
+}
+
+// searchCategories adds the categories the search API offers within the top
+// level category to found. Without a category it offers the top level categories.
+func (c *Client) searchCategories(ctx context.Context, categoryID int, found map[int]Category) error {
+	url, err := QueryRequest{Category: categoryID, Limit: 1}.url(c.baseURL + searchPath)
+	if err != nil {
+		return errs.Wrap(err, "could not get marktplaats query url")
+	}
+	res, err := c.fetch(ctx, url)
+	if err != nil {
+		return err
+	}
+	for _, o := range res.SearchCategoryOptions {
+		found[o.Id] = Category{ID: o.Id, Key: o.Key, Name: o.Name, FullName: o.FullName, ParentID: o.ParentId}
+	}
+	for _, o := range res.CategoriesById {
+		found[o.Id] = Category{ID: o.Id, Key: o.Key, Name: o.Name, FullName: o.FullName, ParentID: o.ParentId}
+	}
+	return nil
+}
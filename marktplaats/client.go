@@ -0,0 +1,153 @@
+package marktplaats
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+)
+
+const (
+	// DefaultBaseURL is the marktplaats site the client talks to by default.
+	DefaultBaseURL = "https://www.marktplaats.nl"
+	// DefaultUserAgent is sent with every request unless configured otherwise.
+	DefaultUserAgent = "Mozilla/5.0 (compatible; spekkoper/1.0)"
+	// DefaultTimeout bounds a single request to marktplaats.
+	DefaultTimeout = 10 * time.Second
+
+	searchPath = "/lrp/api/search"
+)
+
+// Client queries marktplaats. The zero value is not usable, create one with NewClient.
+type Client struct {
+	httpClient *http.Client
+	baseURL    string
+	userAgent  string
+	timeout    time.Duration
+	retry      RetryPolicy
+	limiter    *RateLimiter
+	stats      stats
+}
+
+type ClientOption func(c *Client)
+
+// WithHTTPClient sets the http client used for requests, for example to use a custom transport.
+func WithHTTPClient(hc *http.Client) ClientOption {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithBaseURL points the client to another marktplaats site, for example a fake server in tests.
+func WithBaseURL(baseURL string) ClientOption {
+	return func(c *Client) {
+		c.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// WithUserAgent sets the user agent sent with every request.
+func WithUserAgent(userAgent string) ClientOption {
+	return func(c *Client) {
+		c.userAgent = userAgent
+	}
+}
+
+// WithTimeout sets the deadline of a single request, including reading the response.
+func WithTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+func NewClient(opts ...ClientOption) *Client {
+	c := &Client{
+		httpClient: &http.Client{},
+		baseURL:    DefaultBaseURL,
+		userAgent:  DefaultUserAgent,
+		timeout:    DefaultTimeout,
+		retry:      DefaultRetryPolicy,
+		limiter:    DefaultRateLimiter,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// responseCheck verifies the response of a request, and classifies it if it failed.
+type responseCheck func(res *http.Response, body []byte) error
+
+// get performs a GET request against the url and reads the response body. The
+// request is retried according to the retry policy of the client when it fails,
+// or when the check classifies the response as a transient failure.
+func (c *Client) get(ctx context.Context, url string, check responseCheck) (*http.Response, []byte, error) {
+	c.stats.requests.Add(1)
+	for attempt := 1; ; attempt++ {
+		res, body, err := c.attempt(ctx, url)
+		if err == nil {
+			err = check(res, body)
+		}
+		if err == nil {
+			if attempt > 1 {
+				c.stats.recovered.Add(1)
+			}
+			return res, body, nil
+		}
+
+		d, retry := c.retry.delay(attempt, err)
+		if !retry || attempt >= c.retry.MaxAttempts || ctx.Err() != nil {
+			c.stats.failed.Add(1)
+			return nil, nil, err
+		}
+		if err := sleep(ctx, d); err != nil {
+			c.stats.failed.Add(1)
+			return nil, nil, err
+		}
+		c.stats.retries.Add(1)
+	}
+}
+
+// attempt performs a single GET request, bounded by the context and the timeout
+// of the client. It waits for the rate limiter before sending the request.
+func (c *Client) attempt(ctx context.Context, url string) (*http.Response, []byte, error) {
+	if err := c.limiter.Wait(ctx); err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, requestError(ctx, err)
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, requestError(ctx, err)
+	}
+	return res, b, nil
+}
+
+// requestError converts the error of a failed request into an error with a matching code.
+func requestError(ctx context.Context, err error) error {
+	var netErr net.Error
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		return &errs.Error{Code: errs.Canceled, Message: "marktplaats request canceled"}
+	case errors.Is(ctx.Err(), context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return &errs.Error{Code: errs.DeadlineExceeded, Message: "marktplaats request timed out"}
+	default:
+		return &errs.Error{Code: errs.Unavailable, Message: "marktplaats request failed: " + err.Error()}
+	}
+}
@@ -209,24 +209,18 @@ type resultDto struct {
 			IsDefault           bool        `json:"isDefault"`
 		} `json:"offeredSince"`
 	} `json:"attributeHierarchy"`
-	CategoriesById struct {
-		Field1 struct {
-			FullName string `json:"fullName"`
-			Id       int    `json:"id"`
-			Key      string `json:"key"`
-			Name     string `json:"name"`
-			ParentId int    `json:"parentId"`
-		} `json:"280"`
-		Field2 struct {
-			FullName string `json:"fullName"`
-			Id       int    `json:"id"`
-			Key      string `json:"key"`
-			Name     string `json:"name"`
-		} `json:"1847"`
-	} `json:"categoriesById"`
-	MetaTags struct {
+	CategoriesById map[string]categoryDto `json:"categoriesById"`
+	MetaTags       struct {
 		MetaTitle       string `json:"metaTitle"`
 		MetaDescription string `json:"metaDescription"`
 		PageTitleH1     string `json:"pageTitleH1"`
 	} `json:"metaTags"`
 }
+
+type categoryDto struct {
+	FullName string `json:"fullName"`
+	Id       int    `json:"id"`
+	Key      string `json:"key"`
+	Name     string `json:"name"`
+	ParentId int    `json:"parentId"`
+}
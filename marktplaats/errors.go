@@ -0,0 +1,107 @@
+package marktplaats
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+)
+
+// ErrorKind classifies the ways marktplaats can fail to answer a request.
+type ErrorKind string
+
+const (
+	// ErrRateLimited means marktplaats throttles our requests, retry after UpstreamError.RetryAfter.
+	ErrRateLimited ErrorKind = "rate_limited"
+	// ErrBlocked means marktplaats blocks our requests, for example with a captcha page.
+	ErrBlocked ErrorKind = "blocked"
+	// ErrUpstream means marktplaats failed to handle the request, it is usually transient.
+	ErrUpstream ErrorKind = "upstream_error"
+	// ErrSchemaChanged means the response could not be understood, the API probably changed.
+	ErrSchemaChanged ErrorKind = "schema_changed"
+)
+
+// UpstreamError details a failed response of marktplaats. It is reported as the
+// details of an *errs.Error, use UpstreamErrorOf to retrieve it.
+type UpstreamError struct {
+	Kind       ErrorKind
+	StatusCode int
+	// RetryAfter is the delay marktplaats asked for before retrying, if any.
+	RetryAfter time.Duration
+}
+
+func (*UpstreamError) ErrDetails() {}
+
+// UpstreamErrorOf returns the details of the failed marktplaats response in err, if any.
+func UpstreamErrorOf(err error) (*UpstreamError, bool) {
+	var e *errs.Error
+	if !errors.As(err, &e) {
+		return nil, false
+	}
+	d, ok := e.Details.(*UpstreamError)
+	return d, ok
+}
+
+var errorCodes = map[ErrorKind]errs.ErrCode{
+	ErrRateLimited:   errs.ResourceExhausted,
+	ErrBlocked:       errs.PermissionDenied,
+	ErrUpstream:      errs.Unavailable,
+	ErrSchemaChanged: errs.Internal,
+}
+
+func upstreamError(d *UpstreamError, format string, args ...interface{}) error {
+	return &errs.Error{
+		Code:    errorCodes[d.Kind],
+		Message: fmt.Sprintf(format, args...),
+		Details: d,
+	}
+}
+
+// checkResponse classifies a response with an unexpected status code.
+func checkResponse(res *http.Response) error {
+	switch {
+	case res.StatusCode == http.StatusTooManyRequests:
+		d := &UpstreamError{Kind: ErrRateLimited, StatusCode: res.StatusCode, RetryAfter: retryAfter(res.Header.Get("Retry-After"))}
+		return upstreamError(d, "marktplaats is rate limiting requests, retry after %s", d.RetryAfter)
+	case res.StatusCode == http.StatusForbidden:
+		return upstreamError(&UpstreamError{Kind: ErrBlocked, StatusCode: res.StatusCode}, "marktplaats blocked the request: %s", res.Status)
+	case res.StatusCode >= 500:
+		return upstreamError(&UpstreamError{Kind: ErrUpstream, StatusCode: res.StatusCode}, "marktplaats failed to handle the request: %s", res.Status)
+	case res.StatusCode >= 300:
+		return upstreamError(&UpstreamError{Kind: ErrSchemaChanged, StatusCode: res.StatusCode}, "unexpected response from marktplaats: %s", res.Status)
+	}
+	return nil
+}
+
+// checkJSONResponse additionally verifies that a successful response of the search API is JSON.
+// Captcha and consent pages are served as HTML with a 200 status.
+func checkJSONResponse(res *http.Response, body []byte) error {
+	if err := checkResponse(res); err != nil {
+		return err
+	}
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") || bytes.HasPrefix(bytes.TrimSpace(body), []byte("<")) {
+		return upstreamError(&UpstreamError{Kind: ErrBlocked, StatusCode: res.StatusCode}, "marktplaats responded with an html page instead of search results")
+	}
+	return nil
+}
+
+// retryAfter parses the value of a Retry-After header, in seconds or as an http date.
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -2,27 +2,668 @@ package marktplaats
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
 	"testing"
+	"time"
 
+	"encore.app/marktplaats/marktplaatstest"
+	"encore.dev/beta/errs"
 	"github.com/stretchr/testify/assert"
 )
 
+// fastRetries retries quickly, to keep the tests fast.
+var fastRetries = RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+
+func newTestClient(t *testing.T) (*Client, *marktplaatstest.Server) {
+	srv := marktplaatstest.NewServer()
+	t.Cleanup(srv.Close)
+	return NewClient(WithBaseURL(srv.URL), WithRetryPolicy(fastRetries), WithRateLimiter(nil)), srv
+}
+
 func TestParseURL(t *testing.T) {
-	rawURL := "https://www.marktplaats.nl/l/huis-en-inrichting/kachels/#q:zibro|f:31,32,4205|distanceMeters:50000|postcode:3461CC"
+	categories := SnapshotTaxonomy()
+	tests := []struct {
+		name string
+		url  string
+		want QueryRequest
+	}{
+		{
+			name: "legacy fragment",
+			url:  "https://www.marktplaats.nl/l/huis-en-inrichting/kachels/#q:zibro|f:31,32,4205|distanceMeters:50000|postcode:3461CC",
+			want: QueryRequest{Query: "zibro", Category: 504, SubCategory: 513, AttributesByID: []int{31, 32, 4205}, DistanceMeters: 50000, PostCode: "3461CC"},
+		},
+		{
+			name: "search terms in the path",
+			url:  "https://www.marktplaats.nl/q/zibro/",
+			want: QueryRequest{Query: "zibro"},
+		},
+		{
+			name: "search terms with spaces in the path",
+			url:  "https://www.marktplaats.nl/q/zibro+lc+30/",
+			want: QueryRequest{Query: "zibro lc 30"},
+		},
+		{
+			name: "search terms in the query string",
+			url:  "https://www.marktplaats.nl/q/?query=zibro%20lc-30",
+			want: QueryRequest{Query: "zibro lc-30"},
+		},
+		{
+			name: "search terms with spaces in the fragment",
+			url:  "https://www.marktplaats.nl/#q:zibro+kachel",
+			want: QueryRequest{Query: "zibro kachel"},
+		},
+		{
+			name: "top level category",
+			url:  "https://www.marktplaats.nl/l/huis-en-inrichting/",
+			want: QueryRequest{Category: 504},
+		},
+		{
+			name: "category without trailing slash",
+			url:  "https://www.marktplaats.nl/l/huis-en-inrichting/kachels",
+			want: QueryRequest{Category: 504, SubCategory: 513},
+		},
+		{
+			name: "category and search terms in the path",
+			url:  "https://www.marktplaats.nl/l/huis-en-inrichting/kachels/q/zibro/",
+			want: QueryRequest{Query: "zibro", Category: 504, SubCategory: 513},
+		},
+		{
+			name: "attributes in the path",
+			url:  "https://www.marktplaats.nl/l/huis-en-inrichting/kachels/f/zo-goed-als-nieuw+gebruikt/31+32/",
+			want: QueryRequest{Category: 504, SubCategory: 513, AttributesByID: []int{31, 32}},
+		},
+		{
+			name: "attributes in the path and the fragment",
+			url:  "https://www.marktplaats.nl/l/huis-en-inrichting/kachels/f/gebruikt/32/#f:4205|postcode:3461cc",
+			want: QueryRequest{Category: 504, SubCategory: 513, AttributesByID: []int{32, 4205}, PostCode: "3461CC"},
+		},
+		{
+			name: "page of the results",
+			url:  "https://www.marktplaats.nl/l/huis-en-inrichting/kachels/p/3/#q:zibro",
+			want: QueryRequest{Query: "zibro", Category: 504, SubCategory: 513},
+		},
+		{
+			name: "price range",
+			url:  "https://www.marktplaats.nl/q/zibro/#PriceCentsFrom:1000|PriceCentsTo:15000",
+			want: QueryRequest{Query: "zibro", PriceFromCents: 1000, PriceToCents: 15000},
+		},
+		{
+			name: "open ended price range",
+			url:  "https://www.marktplaats.nl/q/zibro/#PriceCentsTo:15000",
+			want: QueryRequest{Query: "zibro", PriceToCents: 15000},
+		},
+		{
+			name: "price range as attribute range",
+			url:  "https://www.marktplaats.nl/q/?query=zibro&attributeRanges[]=PriceCents:null:15000",
+			want: QueryRequest{Query: "zibro", PriceToCents: 15000},
+		},
+		{
+			name: "attribute ranges",
+			url:  "https://www.marktplaats.nl/l/auto-s/?attributeRanges[]=constructionYear:2010:null&attributeRanges[]=mileage:null:150000",
+			want: QueryRequest{Category: 91, AttributeRanges: []AttributeRange{{Key: "constructionYear", From: 2010}, {Key: "mileage", To: 150000}}},
+		},
+		{
+			name: "offered since",
+			url:  "https://www.marktplaats.nl/l/huis-en-inrichting/kachels/#q:zibro|offeredSince:Gisteren",
+			want: QueryRequest{Query: "zibro", Category: 504, SubCategory: 513, AttributesByKey: []AttributeValue{{Key: "offeredSince", Value: "Gisteren"}}},
+		},
+		{
+			name: "offered since any time is the default",
+			url:  "https://www.marktplaats.nl/q/zibro/#offeredSince:Altijd",
+			want: QueryRequest{Query: "zibro"},
+		},
+		{
+			name: "attributes by key in the query string",
+			url:  "https://www.marktplaats.nl/q/?query=zibro&attributesByKey[]=offeredSince:Vandaag",
+			want: QueryRequest{Query: "zibro", AttributesByKey: []AttributeValue{{Key: "offeredSince", Value: "Vandaag"}}},
+		},
+		{
+			name: "sort options are ignored",
+			url:  "https://www.marktplaats.nl/q/zibro/#sortBy:PRICE|sortOrder:INCREASING|searchInTitleAndDescription:true",
+			want: QueryRequest{Query: "zibro"},
+		},
+		{
+			name: "category ids in the query string",
+			url:  "https://www.marktplaats.nl/q/?query=zibro&categoryId=513",
+			want: QueryRequest{Query: "zibro", Category: 504, SubCategory: 513},
+		},
+		{
+			name: "all categories",
+			url:  "https://www.marktplaats.nl/q/zibro/#categoryId:0",
+			want: QueryRequest{Query: "zibro"},
+		},
+		{
+			name: "distance and postcode in the query string",
+			url:  "https://www.marktplaats.nl/q/zibro/?postcode=3461%20CC&distanceMeters=25000",
+			want: QueryRequest{Query: "zibro", PostCode: "3461CC", DistanceMeters: 25000},
+		},
+		{
+			name: "everything",
+			url:  "https://www.marktplaats.nl/l/huis-en-inrichting/kachels/q/zibro/f/gebruikt/32/#f:4205|distanceMeters:50000|postcode:3461CC|PriceCentsFrom:1000|PriceCentsTo:15000|offeredSince:Gisteren|sortBy:SORT_INDEX|sortOrder:DECREASING",
+			want: QueryRequest{
+				Query: "zibro", Category: 504, SubCategory: 513, AttributesByID: []int{32, 4205},
+				DistanceMeters: 50000, PostCode: "3461CC", PriceFromCents: 1000, PriceToCents: 15000,
+				AttributesByKey: []AttributeValue{{Key: "offeredSince", Value: "Gisteren"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := ParseURL(tt.url, categories)
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, *res)
+			}
+		})
+	}
+}
+
+func TestParseURLErrors(t *testing.T) {
+	categories := SnapshotTaxonomy()
+	code := func(err error) errs.ErrCode {
+		var e *errs.Error
+		if errors.As(err, &e) {
+			return e.Code
+		}
+		return errs.Unknown
+	}
+
+	t.Run("invalid URLs", func(t *testing.T) {
+		for _, rawURL := range []string{"invalid uri", "/l/huis-en-inrichting/", "https://www.marktplaats.nl/%zz"} {
+			_, err := ParseURL(rawURL, categories)
+			assert.Equal(t, errs.InvalidArgument, code(err), rawURL)
+		}
+	})
+	t.Run("unknown categories", func(t *testing.T) {
+		for _, rawURL := range []string{
+			"https://www.marktplaats.nl/l/bestaat-niet/kachels/#q:zibro",
+			"https://www.marktplaats.nl/l/huis-en-inrichting/bestaat-niet/#q:zibro",
+			// a subcategory of another top level category
+			"https://www.marktplaats.nl/l/tuin-en-terras/kachels/#q:zibro",
+			"https://www.marktplaats.nl/q/?query=zibro&categoryId=999999",
+		} {
+			_, err := ParseURL(rawURL, categories)
+			assert.Equal(t, errs.InvalidArgument, code(err), rawURL)
+		}
+	})
+	t.Run("unsupported parts", func(t *testing.T) {
+		tests := []struct {
+			url         string
+			unsupported []string
+		}{
+			{"https://www.marktplaats.nl/v/huis-en-inrichting/kachels/m1934522114-zibro/", []string{"/v/huis-en-inrichting/kachels/m1934522114-zibro"}},
+			{"https://www.marktplaats.nl/l/huis-en-inrichting/kachels/zibro/", []string{"/zibro"}},
+			{"https://www.marktplaats.nl/l/huis-en-inrichting/kachels/f/gebruikt/", []string{"/f/gebruikt"}},
+			{"https://www.marktplaats.nl/q/zibro/p/laatste/", []string{"/p/laatste"}},
+			{"https://www.marktplaats.nl/q/zibro/?foo=bar&bar=baz", []string{"?bar", "?foo"}},
+			{"https://www.marktplaats.nl/q/zibro/#distanceMeters:ver|Language:nl", []string{"#distanceMeters:ver", "#Language:nl"}},
+			{"https://www.marktplaats.nl/q/zibro/#attributeRanges[]:PriceCents:veel:null", []string{"#attributeRanges[]:PriceCents:veel:null"}},
+		}
+		for _, tt := range tests {
+			_, err := ParseURL(tt.url, categories)
+			var e *errs.Error
+			if !assert.True(t, errors.As(err, &e), tt.url) {
+				continue
+			}
+			assert.Equal(t, errs.InvalidArgument, e.Code, tt.url)
+			if details, ok := e.Details.(*URLError); assert.True(t, ok, tt.url) {
+				assert.Equal(t, tt.unsupported, details.Unsupported, tt.url)
+				assert.Equal(t, tt.url, details.URL)
+			}
+		}
+	})
+}
+
+func TestBrowserURL(t *testing.T) {
+	categories := SnapshotTaxonomy()
+	t.Run("examples", func(t *testing.T) {
+		tests := []struct {
+			q    QueryRequest
+			want string
+		}{
+			{QueryRequest{}, "https://www.marktplaats.nl/"},
+			{QueryRequest{Query: "zibro kachel"}, "https://www.marktplaats.nl/q/zibro+kachel/"},
+			{QueryRequest{Query: "p"}, "https://www.marktplaats.nl/#q:p"},
+			{QueryRequest{Category: 504}, "https://www.marktplaats.nl/l/huis-en-inrichting/"},
+			{
+				QueryRequest{
+					Query: "zibro", Category: 504, SubCategory: 513, AttributesByID: []int{31, 32},
+					AttributesByKey: []AttributeValue{{Key: "offeredSince", Value: "Gisteren"}},
+					PriceFromCents:  1000, PriceToCents: 15000, DistanceMeters: 50000, PostCode: "3461CC",
+				},
+				"https://www.marktplaats.nl/l/huis-en-inrichting/kachels/q/zibro/#f:31,32|offeredSince:Gisteren|PriceCentsFrom:1000|PriceCentsTo:15000|distanceMeters:50000|postcode:3461CC",
+			},
+		}
+		for _, tt := range tests {
+			got, err := tt.q.BrowserURL(categories)
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, got)
+			}
+		}
+	})
+	t.Run("unknown categories", func(t *testing.T) {
+		for _, q := range []QueryRequest{{Category: 999999}, {Category: 504, SubCategory: 999999}, {Category: 513}, {Category: 1, SubCategory: 513}} {
+			_, err := q.BrowserURL(categories)
+			var e *errs.Error
+			if assert.True(t, errors.As(err, &e), q) {
+				assert.Equal(t, errs.InvalidArgument, e.Code)
+			}
+		}
+	})
+	t.Run("parses back into the request", func(t *testing.T) {
+		rnd := rand.New(rand.NewSource(1))
+		for i := 0; i < 1000; i++ {
+			q := randomQueryRequest(rnd, categories)
+			browserURL, err := q.BrowserURL(categories)
+			if !assert.NoError(t, err) {
+				return
+			}
+			res, err := ParseURL(browserURL, categories)
+			if !assert.NoError(t, err, browserURL) || !assert.Equal(t, q, *res, browserURL) {
+				return
+			}
+		}
+	})
+}
+
+// randomQueryRequest generates a request with the fields of a search URL, in
+// the form ParseURL returns them.
+func randomQueryRequest(rnd *rand.Rand, categories *Taxonomy) QueryRequest {
+	text := func(alphabet []string, min, max int) string {
+		n := min + rnd.Intn(max-min+1)
+		var s string
+		for i := 0; i < n; i++ {
+			s += alphabet[rnd.Intn(len(alphabet))]
+		}
+		return s
+	}
+	letters := []string{"a", "b", "z", "K", "0", "9"}
+	// terms may contain the characters that separate the parts of the URL
+	terms := append([]string{" ", "/", "+", "|", ":", "%", "#", "?", "&", ",", ".", "é", "l", "q", "f", "p"}, letters...)
+	maybe := func() bool {
+		return rnd.Intn(2) == 0
+	}
+
+	var q QueryRequest
+	if maybe() {
+		q.Query = text(terms, 1, 12)
+	}
+	if maybe() {
+		all := categories.Categories()
+		c := all[rnd.Intn(len(all))]
+		if c.ParentID != 0 {
+			q.Category, q.SubCategory = c.ParentID, c.ID
+		} else {
+			q.Category = c.ID
+		}
+	}
+	for i := rnd.Intn(4); i > 0; i-- {
+		q.AttributesByID = append(q.AttributesByID, 1+rnd.Intn(10000))
+	}
+	for i := rnd.Intn(3); i > 0; i-- {
+		v := AttributeValue{Key: text(letters, 1, 8), Value: text(terms, 1, 8)}
+		if maybe() {
+			v = AttributeValue{Key: offeredSinceAttribute, Value: []string{"Vandaag", "Gisteren", "Een week"}[rnd.Intn(3)]}
+		}
+		q.AttributesByKey = append(q.AttributesByKey, v)
+	}
+	if maybe() {
+		q.PriceFromCents = rnd.Intn(100000)
+	}
+	if maybe() {
+		q.PriceToCents = rnd.Intn(100000)
+	}
+	for i := rnd.Intn(3); i > 0; i-- {
+		q.AttributeRanges = append(q.AttributeRanges, AttributeRange{Key: text(letters, 1, 8), From: rnd.Intn(3000), To: rnd.Intn(3000)})
+	}
+	if maybe() {
+		q.DistanceMeters = 1 + rnd.Intn(100000)
+		q.PostCode = fmt.Sprintf("%04d%s", 1000+rnd.Intn(9000), text([]string{"A", "B", "C", "Z"}, 2, 2))
+	}
+	return q
+}
+
+func TestCategories(t *testing.T) {
+	c, srv := newTestClient(t)
+
+	categories, err := c.Categories(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, []Category{
+		{ID: 504, Key: "huis-en-inrichting", Name: "Huis en Inrichting", FullName: "Huis en Inrichting"},
+		{ID: 513, Key: "kachels", Name: "Kachels", FullName: "Huis en Inrichting > Kachels", ParentID: 504},
+	}, categories)
+	// the top level categories, and the subcategories of huis en inrichting
+	reqs := srv.SearchRequests()
+	if assert.Len(t, reqs, 2) {
+		assert.Empty(t, reqs[0].Get("l1CategoryId"))
+		assert.Equal(t, "504", reqs[1].Get("l1CategoryId"))
+	}
 
-	res, err := ParseURL(context.TODO(), rawURL)
+	taxonomy := NewTaxonomy(categories)
+	category, sub, err := taxonomy.Resolve("huis-en-inrichting", "kachels")
+	assert.NoError(t, err)
+	assert.Equal(t, 504, category.ID)
+	assert.Equal(t, 513, sub.ID)
+}
+
+func TestAttributes(t *testing.T) {
+	c, srv := newTestClient(t)
+
+	attributes, err := c.Attributes(context.TODO(), 504, 513)
+	assert.NoError(t, err)
+	reqs := srv.SearchRequests()
+	if assert.Len(t, reqs, 1) {
+		assert.Equal(t, "513", reqs[0].Get("l2CategoryId"))
+	}
+	if !assert.Len(t, attributes, 3) {
+		return
+	}
+	condition := attributes[0]
+	assert.Equal(t, "condition", condition.Key)
+	assert.Equal(t, "Conditie", condition.Label)
+	assert.Equal(t, []AttributeOption{
+		{ID: 30, Key: "Nieuw", Label: "Nieuw", Count: 1},
+		{ID: 31, Key: "Zo goed als nieuw", Label: "Zo goed als nieuw", Count: 1},
+		{ID: 32, Key: "Gebruikt", Label: "Gebruikt", Count: 2},
+	}, condition.Values)
+	assert.Equal(t, "offeredSince", attributes[2].Key)
+	assert.True(t, attributes[2].SingleSelect)
+	assert.Equal(t, AttributeOption{Key: "Altijd", Label: "Altijd", Default: true}, attributes[2].Values[0])
+
+	t.Run("resolve attributes", func(t *testing.T) {
+		a, v, err := ResolveAttribute(attributes, "condition", "zo-goed-als-nieuw")
+		assert.NoError(t, err)
+		assert.Equal(t, "condition", a.Key)
+		assert.Equal(t, 31, v.ID)
+
+		a, v, err = ResolveAttribute(attributes, "offeredsince", "vandaag")
+		assert.NoError(t, err)
+		assert.Equal(t, "offeredSince", a.Key)
+		assert.Equal(t, AttributeValue{Key: "offeredSince", Value: "Vandaag"}, AttributeValue{Key: a.Key, Value: v.Key})
+
+		var e *errs.Error
+		_, _, err = ResolveAttribute(attributes, "condition", "kapot")
+		if assert.True(t, errors.As(err, &e)) {
+			assert.Equal(t, errs.InvalidArgument, e.Code)
+			assert.Contains(t, e.Message, "Gebruikt")
+		}
+		_, _, err = ResolveAttribute(attributes, "brand", "zibro")
+		assert.Error(t, err)
+	})
+}
+
+func TestQueryRequestURL(t *testing.T) {
+	t.Run("price range", func(t *testing.T) {
+		raw, err := QueryRequest{Query: "kachel", PriceFromCents: 1000, PriceToCents: 15000}.url(DefaultBaseURL + searchPath)
+		assert.NoError(t, err)
+		u, err := url.Parse(raw)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"PriceCents:1000:15000"}, u.Query()["attributeRanges[]"])
+	})
+	t.Run("open ended price range", func(t *testing.T) {
+		raw, err := QueryRequest{Query: "kachel", PriceToCents: 15000}.url(DefaultBaseURL + searchPath)
+		assert.NoError(t, err)
+		u, err := url.Parse(raw)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"PriceCents:null:15000"}, u.Query()["attributeRanges[]"])
+	})
+	t.Run("attributes", func(t *testing.T) {
+		raw, err := QueryRequest{
+			Query:           "auto",
+			AttributesByID:  []int{31, 4205},
+			PriceToCents:    500000,
+			AttributeRanges: []AttributeRange{{Key: "constructionYear", From: 2010}, {Key: "mileage", To: 150000}},
+			AttributesByKey: []AttributeValue{{Key: "offeredSince", Value: "Gisteren"}},
+		}.url(DefaultBaseURL + searchPath)
+		assert.NoError(t, err)
+		u, err := url.Parse(raw)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"31", "4205"}, u.Query()["attributesById[]"])
+		assert.Equal(t, []string{"PriceCents:null:500000", "constructionYear:2010:null", "mileage:null:150000"}, u.Query()["attributeRanges[]"])
+		assert.Equal(t, []string{"offeredSince:Gisteren"}, u.Query()["attributesByKey[]"])
+	})
+}
+
+func TestQueryRequestValidate(t *testing.T) {
+	assert.NoError(t, QueryRequest{
+		AttributeRanges: []AttributeRange{{Key: "constructionYear", From: 2010, To: 2020}},
+		AttributesByKey: []AttributeValue{{Key: "offeredSince", Value: "Gisteren"}},
+		PriceFromCents:  1000,
+		PriceToCents:    1000,
+	}.Validate())
+	for name, q := range map[string]QueryRequest{
+		"negative price":          {PriceToCents: -1},
+		"inverted price range":    {PriceFromCents: 5000, PriceToCents: 1000},
+		"range without key":       {AttributeRanges: []AttributeRange{{From: 1}}},
+		"range without bounds":    {AttributeRanges: []AttributeRange{{Key: "mileage"}}},
+		"inverted range":          {AttributeRanges: []AttributeRange{{Key: "mileage", From: 10, To: 1}}},
+		"price range":             {AttributeRanges: []AttributeRange{{Key: "PriceCents", From: 100}}},
+		"attribute without value": {AttributesByKey: []AttributeValue{{Key: "offeredSince"}}},
+	} {
+		var e *errs.Error
+		if assert.True(t, errors.As(q.Validate(), &e), name) {
+			assert.Equal(t, errs.InvalidArgument, e.Code, name)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	c, srv := newTestClient(t)
+	ctx := context.TODO()
+
+	res, err := c.Query(ctx, QueryRequest{Query: "zibro", Category: 504, SubCategory: 513, AttributesByID: []int{31, 32}})
 	assert.NoError(t, err)
 	if assert.NotNil(t, res) {
-		assert.Equal(t, "zibro", res.Query)
-		assert.Equal(t, 504, res.Category)
-		assert.Equal(t, 513, res.SubCategory)
-		assert.Equal(t, "3461CC", res.PostCode)
-		assert.Equal(t, 50000, res.DistanceMeters)
-		assert.Equal(t, []int{31, 32, 4205}, res.AttributesByID)
+		// the commercial seller and the reserved advertisement are left out
+		assert.Len(t, res.Advertisements, 2)
+		assert.Equal(t, 4, res.TotalResultCount)
+		ad := res.Advertisements[0]
+		assert.Equal(t, "m1934522114", ad.ID)
+		assert.Equal(t, "Zibro LC-30 petroleumkachel", ad.Title)
+		assert.Equal(t, "Barneveld", ad.Location.CityName)
+		assert.Equal(t, 5000, ad.PriceInfo.PriceCents)
+		assert.Equal(t, srv.URL+"/v/huis-en-inrichting/kachels/m1934522114-zibro-lc-30-petroleumkachel", ad.URL)
 	}
+	reqs := srv.SearchRequests()
+	if assert.Len(t, reqs, 1) {
+		assert.Equal(t, "zibro", reqs[0].Get("query"))
+		assert.Equal(t, "504", reqs[0].Get("l1CategoryId"))
+		assert.Equal(t, "513", reqs[0].Get("l2CategoryId"))
+		assert.Equal(t, []string{"31", "32"}, reqs[0]["attributesById[]"])
+	}
+
+	t.Run("include commercial sellers", func(t *testing.T) {
+		res, err := c.Query(ctx, QueryRequest{Query: "zibro", IncludeCommercials: true})
+		assert.NoError(t, err)
+		assert.Len(t, res.Advertisements, 3)
+	})
+	t.Run("enforce the price range", func(t *testing.T) {
+		res, err := c.Query(ctx, QueryRequest{Query: "zibro", PriceToCents: 15000})
+		assert.NoError(t, err)
+		if assert.Len(t, res.Advertisements, 1) {
+			assert.Equal(t, "m1934522114", res.Advertisements[0].ID)
+		}
+	})
+}
 
-	t.Run("pass in an invalid URL", func(t *testing.T) {
-		_, err := ParseURL(context.TODO(), "invalid uri")
+func TestQueryCancellation(t *testing.T) {
+	srv := marktplaatstest.NewServer()
+	defer srv.Close()
+	srv.HandleSearch(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	errCode := func(err error) errs.ErrCode {
+		var e *errs.Error
+		if errors.As(err, &e) {
+			return e.Code
+		}
+		return errs.Unknown
+	}
+
+	t.Run("client timeout", func(t *testing.T) {
+		c := NewClient(WithBaseURL(srv.URL), WithTimeout(20*time.Millisecond), WithRetryPolicy(fastRetries), WithRateLimiter(nil))
+		_, err := c.Query(context.Background(), QueryRequest{Query: "zibro"})
+		assert.Equal(t, errs.DeadlineExceeded, errCode(err))
+	})
+	t.Run("context deadline", func(t *testing.T) {
+		c := NewClient(WithBaseURL(srv.URL), WithRateLimiter(nil))
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err := c.Categories(ctx)
+		assert.Equal(t, errs.DeadlineExceeded, errCode(err))
+	})
+	t.Run("canceled context", func(t *testing.T) {
+		c := NewClient(WithBaseURL(srv.URL), WithRateLimiter(nil))
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		_, err := c.Query(ctx, QueryRequest{Query: "zibro"})
+		assert.Equal(t, errs.Canceled, errCode(err))
+	})
+}
+
+func TestQueryUpstreamErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		header     map[string]string
+		body       string
+		kind       ErrorKind
+		code       errs.ErrCode
+		retryAfter time.Duration
+	}{
+		{name: "rate limited", status: 429, header: map[string]string{"Retry-After": "30"}, kind: ErrRateLimited, code: errs.ResourceExhausted, retryAfter: 30 * time.Second},
+		{name: "forbidden", status: 403, body: "<html>blocked</html>", kind: ErrBlocked, code: errs.PermissionDenied},
+		{name: "captcha page", status: 200, header: map[string]string{"Content-Type": "text/html"}, body: "<html>captcha</html>", kind: ErrBlocked, code: errs.PermissionDenied},
+		{name: "server error", status: 503, kind: ErrUpstream, code: errs.Unavailable},
+		{name: "errors in the response", status: 200, body: `{"hasErrors": true}`, kind: ErrUpstream, code: errs.Unavailable},
+		{name: "unexpected json", status: 200, body: `{"listings": "none"}`, kind: ErrSchemaChanged, code: errs.Internal},
+		{name: "endpoint moved", status: 404, kind: ErrSchemaChanged, code: errs.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, srv := newTestClient(t)
+			srv.HandleSearch(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tt.header {
+					w.Header().Set(k, v)
+				}
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			})
+			_, err := c.Query(context.TODO(), QueryRequest{Query: "zibro"})
+			var e *errs.Error
+			if assert.True(t, errors.As(err, &e)) {
+				assert.Equal(t, tt.code, e.Code)
+			}
+			d, ok := UpstreamErrorOf(err)
+			if assert.True(t, ok) {
+				assert.Equal(t, tt.kind, d.Kind)
+				assert.Equal(t, tt.status, d.StatusCode)
+				assert.Equal(t, tt.retryAfter, d.RetryAfter)
+			}
+		})
+	}
+}
+
+func TestQueryRetry(t *testing.T) {
+	t.Run("recover from transient failures", func(t *testing.T) {
+		c, srv := newTestClient(t)
+		failures := 2
+		srv.HandleSearch(func(w http.ResponseWriter, r *http.Request) {
+			if failures > 0 {
+				failures--
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			_, _ = w.Write(marktplaatstest.SearchFixture)
+		})
+		res, err := c.Query(context.TODO(), QueryRequest{Query: "zibro"})
+		assert.NoError(t, err)
+		assert.NotNil(t, res)
+		assert.Len(t, srv.SearchRequests(), 3)
+		assert.Equal(t, Stats{Requests: 1, Retries: 2, Recovered: 1}, c.Stats())
+	})
+	t.Run("give up after the maximum attempts", func(t *testing.T) {
+		c, srv := newTestClient(t)
+		srv.HandleSearch(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		})
+		_, err := c.Query(context.TODO(), QueryRequest{Query: "zibro"})
+		assert.Error(t, err)
+		assert.Len(t, srv.SearchRequests(), 3)
+		assert.Equal(t, Stats{Requests: 1, Retries: 2, Failed: 1}, c.Stats())
+	})
+	t.Run("do not retry permanent failures", func(t *testing.T) {
+		c, srv := newTestClient(t)
+		srv.HandleSearch(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		})
+		_, err := c.Query(context.TODO(), QueryRequest{Query: "zibro"})
+		assert.Error(t, err)
+		assert.Len(t, srv.SearchRequests(), 1)
+	})
+	t.Run("do not wait longer than the maximum backoff", func(t *testing.T) {
+		c, srv := newTestClient(t)
+		srv.HandleSearch(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+		})
+		_, err := c.Query(context.TODO(), QueryRequest{Query: "zibro"})
 		assert.Error(t, err)
+		assert.Len(t, srv.SearchRequests(), 1)
 	})
 }
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for retry, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		d := p.backoff(retry + 1)
+		assert.GreaterOrEqual(t, d, max/2)
+		assert.LessOrEqual(t, d, max)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(50, 2)
+	ctx := context.TODO()
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, l.Wait(ctx))
+	}
+	// the burst is immediate, the two requests after it wait for 20ms each
+	assert.GreaterOrEqual(t, time.Since(start), 35*time.Millisecond)
+
+	t.Run("shared between clients", func(t *testing.T) {
+		srv := marktplaatstest.NewServer()
+		defer srv.Close()
+		l := NewRateLimiter(50, 1)
+		a := NewClient(WithBaseURL(srv.URL), WithRateLimiter(l))
+		b := NewClient(WithBaseURL(srv.URL), WithRateLimiter(l))
+		start := time.Now()
+		for _, c := range []*Client{a, b, a} {
+			_, err := c.Query(ctx, QueryRequest{Query: "zibro"})
+			assert.NoError(t, err)
+		}
+		assert.GreaterOrEqual(t, time.Since(start), 35*time.Millisecond)
+	})
+	t.Run("canceled while waiting", func(t *testing.T) {
+		l := NewRateLimiter(0.1, 1)
+		assert.NoError(t, l.Wait(ctx))
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		assert.Error(t, l.Wait(ctx))
+	})
+}
+
+func TestInPriceRange(t *testing.T) {
+	q := QueryRequest{PriceFromCents: 5000, PriceToCents: 15000}
+	assert.False(t, q.inPriceRange(4999))
+	assert.True(t, q.inPriceRange(5000))
+	assert.True(t, q.inPriceRange(15000))
+	assert.False(t, q.inPriceRange(40000))
+	assert.True(t, QueryRequest{}.inPriceRange(40000))
+}
@@ -0,0 +1,67 @@
+// Package marktplaatstest provides a fake marktplaats server, serving recorded
+// responses, for testing the marktplaats client and its users offline.
+package marktplaatstest
+
+import (
+	_ "embed"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+)
+
+// SearchFixture is a recorded response of the search API for zibro heaters.
+//
+//go:embed testdata/search.json
+var SearchFixture []byte
+
+const searchPath = "/lrp/api/search"
+
+// Server is a fake marktplaats site. The search API responds with SearchFixture,
+// unless overridden with HandleSearch.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	search   http.HandlerFunc
+	requests []url.Values
+}
+
+// NewServer starts a fake marktplaats server, callers should Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		search: func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(SearchFixture)
+		},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// HandleSearch replaces the handler of the search API.
+func (s *Server) HandleSearch(h http.HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.search = h
+}
+
+// SearchRequests returns the query parameters of the search API requests received so far.
+func (s *Server) SearchRequests() []url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]url.Values(nil), s.requests...)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case searchPath:
+		s.mu.Lock()
+		s.requests = append(s.requests, r.URL.Query())
+		h := s.search
+		s.mu.Unlock()
+		h(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
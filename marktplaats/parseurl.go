@@ -0,0 +1,423 @@
+package marktplaats
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"encore.dev/beta/errs"
+)
+
+// ParseURL parses a marktplaats search URL copied from the browser into a
+// QueryRequest. The category slugs in the path are resolved with the taxonomy.
+// It understands the paths
+//
+//	/l/<category>/[<subcategory>/]   the category to search in
+//	/q/<term>/                       the search terms
+//	/f/<slug>+<slug>/<id>+<id>/      attributes, by their slug and id
+//	/p/<page>/                       the page of the results, it is ignored
+//
+// and the parameters in the query string (?query=zibro&postcode=3461CC) or in
+// the fragment (#q:zibro|f:31,32|postcode:3461CC), see urlParams. Parts of the
+// URL that are not understood are reported in the details of the error, as
+// a *URLError, rather than silently searching for something else.
+func ParseURL(rawURL string, categories *Taxonomy) (*QueryRequest, error) {
+	uri, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || !uri.IsAbs() {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("%q is not an absolute URL", rawURL)}
+	}
+	p := &urlParser{categories: categories}
+	p.parsePath(uri.EscapedPath())
+	params := uri.Query()
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range params[name] {
+			p.param("?"+name, name, v)
+		}
+	}
+	// the fragment is split as written, so an escaped | in a value doesn't
+	// separate parameters
+	_, fragment, _ := strings.Cut(strings.TrimSpace(rawURL), "#")
+	for _, part := range strings.Split(fragment, "|") {
+		if part == "" {
+			continue
+		}
+		name, v, _ := strings.Cut(part, ":")
+		// spaces are written as + in the fragment: #q:zibro+kachel
+		if unescaped, err := url.QueryUnescape(v); err == nil {
+			v = unescaped
+		}
+		p.param("#"+part, name, v)
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	if len(p.unsupported) > 0 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "unsupported parts in marktplaats URL: " + strings.Join(p.unsupported, ", "),
+			Details: &URLError{URL: rawURL, Unsupported: p.unsupported},
+		}
+	}
+	return &p.q, nil
+}
+
+// URLError details the parts of a marktplaats URL that ParseURL does not
+// understand. It is reported as the details of an *errs.Error.
+type URLError struct {
+	URL string
+	// Unsupported lists the path segments and parameters that are not
+	// understood, for example /x/y or ?view.
+	Unsupported []string
+}
+
+func (*URLError) ErrDetails() {}
+
+type urlParser struct {
+	categories  *Taxonomy
+	q           QueryRequest
+	unsupported []string
+	// err is a part of the URL that is understood, but not valid, like an unknown category.
+	err error
+}
+
+func (p *urlParser) unsupportedPart(part string) {
+	p.unsupported = append(p.unsupported, part)
+}
+
+func (p *urlParser) fail(err error) {
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// parsePath parses the path segments of the URL, see ParseURL.
+func (p *urlParser) parsePath(path string) {
+	var segments []string
+	for _, s := range strings.Split(path, "/") {
+		if s != "" {
+			segments = append(segments, s)
+		}
+	}
+	for i := 0; i < len(segments); {
+		parse, ok := pathMarkers[segments[i]]
+		if !ok {
+			p.unsupportedPart("/" + strings.Join(segments[i:], "/"))
+			return
+		}
+		// the arguments of a marker end at the next marker, like /l/fietsen/q/gazelle/
+		end := i + 1
+		for end < len(segments) {
+			if _, ok := pathMarkers[segments[end]]; ok {
+				break
+			}
+			end++
+		}
+		n := parse(p, segments[i+1:end])
+		if n < 0 {
+			p.unsupportedPart("/" + strings.Join(segments[i:end], "/"))
+			n = end - i - 1
+		}
+		i += 1 + n
+	}
+}
+
+// pathMarker parses the arguments following a marker segment in the path. It
+// returns the number of arguments used, or -1 if they are not understood.
+type pathMarker func(p *urlParser, args []string) int
+
+var pathMarkers = map[string]pathMarker{
+	"l": parseCategories,
+	"q": func(p *urlParser, args []string) int {
+		// the search terms may be in the query string instead: /q/?query=zibro
+		if len(args) == 0 {
+			return 0
+		}
+		term, err := url.QueryUnescape(args[0])
+		if err != nil {
+			return -1
+		}
+		p.q.Query = term
+		return 1
+	},
+	"f": func(p *urlParser, args []string) int {
+		// the slugs of the attributes are followed by their ids: /f/nieuw+gebruikt/30+32/
+		if len(args) < 2 {
+			return -1
+		}
+		ids, ok := parseIDs(args[1], "+")
+		if !ok {
+			return -1
+		}
+		p.q.AttributesByID = append(p.q.AttributesByID, ids...)
+		return 2
+	},
+	"p": func(p *urlParser, args []string) int {
+		if len(args) == 0 {
+			return -1
+		}
+		if _, err := strconv.Atoi(args[0]); err != nil {
+			return -1
+		}
+		return 1
+	},
+}
+
+// parseCategories parses /l/<category>/[<subcategory>/].
+func parseCategories(p *urlParser, args []string) int {
+	if len(args) == 0 {
+		return -1
+	}
+	var subKey string
+	if len(args) > 1 {
+		subKey = args[1]
+	}
+	category, sub, err := p.categories.Resolve(args[0], subKey)
+	if err != nil {
+		p.fail(err)
+	}
+	p.q.Category, p.q.SubCategory = category.ID, sub.ID
+	if subKey != "" {
+		return 2
+	}
+	return 1
+}
+
+// param parses a parameter of the query string or the fragment. The part is
+// the parameter as written in the URL, it is reported when not understood.
+func (p *urlParser) param(part, name, value string) {
+	parse, ok := urlParams[name]
+	if !ok || !parse(p, value) {
+		p.unsupportedPart(part)
+	}
+}
+
+// urlParams parses the value of a parameter in the query string or fragment
+// into the request, it reports whether the value is understood.
+var urlParams = map[string]func(p *urlParser, v string) bool{
+	"q":     parseQuery,
+	"query": parseQuery,
+
+	"f":                parseAttributesByID,
+	"attributesById":   parseAttributesByID,
+	"attributesById[]": parseAttributesByID,
+
+	"attributesByKey":   parseAttributeByKey,
+	"attributesByKey[]": parseAttributeByKey,
+	"offeredSince": func(p *urlParser, v string) bool {
+		return parseAttributeByKey(p, offeredSinceAttribute+":"+v)
+	},
+
+	"attributeRanges":   parseAttributeRange,
+	"attributeRanges[]": parseAttributeRange,
+	"PriceCentsFrom":    parseInt(func(q *QueryRequest) *int { return &q.PriceFromCents }),
+	"PriceCentsTo":      parseInt(func(q *QueryRequest) *int { return &q.PriceToCents }),
+
+	"postcode":       parsePostCode,
+	"distanceMeters": parseInt(func(q *QueryRequest) *int { return &q.DistanceMeters }),
+
+	"categoryId":   parseCategoryID,
+	"l1CategoryId": parseCategoryID,
+	"l2CategoryId": parseCategoryID,
+
+	// the order and presentation of the results don't change which
+	// advertisements match, the service always walks them newest first
+	"sortBy":                      ignore,
+	"sortOrder":                   ignore,
+	"sortAttribute":               ignore,
+	"searchInTitleAndDescription": ignore,
+	"view":                        ignore,
+	"viewOptions":                 ignore,
+	"limit":                       ignore,
+	"offset":                      ignore,
+}
+
+func ignore(*urlParser, string) bool {
+	return true
+}
+
+func parseQuery(p *urlParser, v string) bool {
+	p.q.Query = v
+	return true
+}
+
+func parsePostCode(p *urlParser, v string) bool {
+	p.q.PostCode = strings.ToUpper(strings.ReplaceAll(v, " ", ""))
+	return true
+}
+
+func parseInt(field func(q *QueryRequest) *int) func(p *urlParser, v string) bool {
+	return func(p *urlParser, v string) bool {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return false
+		}
+		*field(&p.q) = n
+		return true
+	}
+}
+
+func parseIDs(v, sep string) ([]int, bool) {
+	var ids []int
+	for _, s := range strings.Split(v, sep) {
+		id, err := strconv.Atoi(s)
+		if err != nil || id <= 0 {
+			return nil, false
+		}
+		ids = append(ids, id)
+	}
+	return ids, true
+}
+
+func parseAttributesByID(p *urlParser, v string) bool {
+	ids, ok := parseIDs(v, ",")
+	if !ok {
+		return false
+	}
+	p.q.AttributesByID = append(p.q.AttributesByID, ids...)
+	return true
+}
+
+func parseAttributeByKey(p *urlParser, v string) bool {
+	key, value, ok := strings.Cut(v, ":")
+	if !ok || key == "" || value == "" {
+		return false
+	}
+	// all advertisements, whatever their age, are the default
+	if key == offeredSinceAttribute && value == "Altijd" {
+		return true
+	}
+	p.q.AttributesByKey = append(p.q.AttributesByKey, AttributeValue{Key: key, Value: value})
+	return true
+}
+
+func parseAttributeRange(p *urlParser, v string) bool {
+	parts := strings.Split(v, ":")
+	if len(parts) != 3 || parts[0] == "" {
+		return false
+	}
+	bound := func(s string) (int, bool) {
+		if s == "null" || s == "" {
+			return 0, true
+		}
+		n, err := strconv.Atoi(s)
+		return n, err == nil && n >= 0
+	}
+	from, ok := bound(parts[1])
+	if !ok {
+		return false
+	}
+	to, ok := bound(parts[2])
+	if !ok {
+		return false
+	}
+	if parts[0] == priceAttribute {
+		p.q.PriceFromCents, p.q.PriceToCents = from, to
+		return true
+	}
+	p.q.AttributeRanges = append(p.q.AttributeRanges, AttributeRange{Key: parts[0], From: from, To: to})
+	return true
+}
+
+func parseCategoryID(p *urlParser, v string) bool {
+	id, err := strconv.Atoi(v)
+	if err != nil {
+		return false
+	}
+	if id == 0 {
+		// all categories
+		return true
+	}
+	c, ok := p.categories.Category(id)
+	if !ok {
+		p.fail(&errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("unknown category %d", id)})
+		return true
+	}
+	if c.ParentID != 0 {
+		p.q.Category, p.q.SubCategory = c.ParentID, c.ID
+	} else {
+		p.q.Category = c.ID
+	}
+	return true
+}
+
+// BrowserURL returns the marktplaats URL that opens the search in a browser.
+// The category slugs in the path are looked up in the taxonomy. ParseURL
+// parses the URL back into the same request, except for the limit, offset and
+// commercials which are not part of a search URL.
+func (qr QueryRequest) BrowserURL(categories *Taxonomy) (string, error) {
+	path := "/"
+	if qr.Category > 0 || qr.SubCategory > 0 {
+		category, ok := categories.Category(qr.Category)
+		if !ok || category.ParentID != 0 {
+			return "", &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("unknown category %d", qr.Category)}
+		}
+		path += "l/" + category.Key + "/"
+		if qr.SubCategory > 0 {
+			sub, ok := categories.Category(qr.SubCategory)
+			if !ok || sub.ParentID != category.ID {
+				return "", &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("unknown category %d in %d", qr.SubCategory, qr.Category)}
+			}
+			path += sub.Key + "/"
+		}
+	}
+
+	var fragment []string
+	param := func(name, v string) {
+		fragment = append(fragment, name+":"+fragmentEscaper.Replace(url.QueryEscape(v)))
+	}
+	if qr.Query != "" {
+		// a term that reads as a path segment is searched for in the fragment
+		term := url.QueryEscape(qr.Query)
+		if _, marker := pathMarkers[term]; marker || term == "." || term == ".." {
+			param("q", qr.Query)
+		} else {
+			path += "q/" + term + "/"
+		}
+	}
+	if len(qr.AttributesByID) > 0 {
+		ids := make([]string, len(qr.AttributesByID))
+		for i, id := range qr.AttributesByID {
+			ids[i] = strconv.Itoa(id)
+		}
+		param("f", strings.Join(ids, ","))
+	}
+	for _, v := range qr.AttributesByKey {
+		if v.Key == offeredSinceAttribute {
+			param(offeredSinceAttribute, v.Value)
+		} else {
+			param("attributesByKey[]", v.String())
+		}
+	}
+	if qr.PriceFromCents > 0 {
+		param("PriceCentsFrom", strconv.Itoa(qr.PriceFromCents))
+	}
+	if qr.PriceToCents > 0 {
+		param("PriceCentsTo", strconv.Itoa(qr.PriceToCents))
+	}
+	for _, r := range qr.AttributeRanges {
+		param("attributeRanges[]", r.String())
+	}
+	if qr.DistanceMeters > 0 {
+		param("distanceMeters", strconv.Itoa(qr.DistanceMeters))
+	}
+	if qr.PostCode != "" {
+		param("postcode", qr.PostCode)
+	}
+
+	browserURL := DefaultBaseURL + path
+	if len(fragment) > 0 {
+		browserURL += "#" + strings.Join(fragment, "|")
+	}
+	return browserURL, nil
+}
+
+// fragmentEscaper keeps the separators within fragment values readable, only
+// the | separates the parameters.
+var fragmentEscaper = strings.NewReplacer("%2C", ",", "%3A", ":")
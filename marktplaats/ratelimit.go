@@ -0,0 +1,85 @@
+package marktplaats
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting the rate of requests to marktplaats.
+// It allows bursts of up to burst requests and refills at rps tokens per second.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rps    float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// DefaultRateLimiter is shared by all clients created without WithRateLimiter,
+// so all requests of the process are limited together.
+var DefaultRateLimiter = NewRateLimiter(1, 5)
+
+// NewRateLimiter creates a rate limiter allowing rps requests per second with
+// bursts of up to burst requests. A rate of zero or less disables the limit.
+func NewRateLimiter(rps float64, burst int) *RateLimiter {
+	l := &RateLimiter{}
+	l.SetLimit(rps, burst)
+	return l
+}
+
+// SetLimit changes the rate and burst of the limiter.
+func (l *RateLimiter) SetLimit(rps float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if burst < 1 {
+		burst = 1
+	}
+	l.rps = rps
+	l.burst = float64(burst)
+	l.tokens = l.burst
+	l.last = time.Now()
+}
+
+// Wait blocks until a request is allowed, or the context is done.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if l.rps <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rps
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	// take the token now, and wait until it would have been refilled
+	l.tokens--
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rps * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if d == 0 {
+		return nil
+	}
+	if err := sleep(ctx, d); err != nil {
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// WithRateLimiter sets the rate limiter of the client, nil disables rate limiting.
+func WithRateLimiter(l *RateLimiter) ClientOption {
+	return func(c *Client) {
+		c.limiter = l
+	}
+}
@@ -0,0 +1,119 @@
+package marktplaats
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"encore.dev/beta/errs"
+)
+
+// RetryPolicy configures how failed requests to marktplaats are retried.
+// Only requests that failed with a transient error are retried: network errors,
+// timeouts of a single attempt, server errors and rate limiting.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first one.
+	// A value of 1 or less disables retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry, it doubles for every next retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts. When marktplaats asks to retry
+	// after a longer delay the request is not retried.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is used by clients created without WithRetryPolicy.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+}
+
+// WithRetryPolicy sets the policy for retrying failed requests.
+func WithRetryPolicy(p RetryPolicy) ClientOption {
+	return func(c *Client) {
+		c.retry = p
+	}
+}
+
+// backoff returns the delay before the given retry, starting at 1. It grows
+// exponentially and half of it is random, so clients don't retry in lockstep.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// delay returns the delay before retrying after err, and whether it should be retried at all.
+func (p RetryPolicy) delay(retry int, err error) (time.Duration, bool) {
+	d := p.backoff(retry)
+	if upstream, ok := UpstreamErrorOf(err); ok {
+		switch upstream.Kind {
+		case ErrRateLimited:
+			if upstream.RetryAfter > p.MaxBackoff {
+				return 0, false
+			}
+			if upstream.RetryAfter > d {
+				d = upstream.RetryAfter
+			}
+			return d, true
+		case ErrUpstream:
+			return d, true
+		default:
+			return 0, false
+		}
+	}
+	var e *errs.Error
+	if errors.As(err, &e) && (e.Code == errs.Unavailable || e.Code == errs.DeadlineExceeded) {
+		return d, true
+	}
+	return 0, false
+}
+
+// Stats counts the requests made by a client, to tell transient failures from persistent breakage.
+type Stats struct {
+	// Requests is the number of requests, not counting retries.
+	Requests int64
+	// Retries is the number of attempts that retried a failed request.
+	Retries int64
+	// Recovered is the number of requests that succeeded after one or more retries.
+	Recovered int64
+	// Failed is the number of requests that failed, after retrying if possible.
+	Failed int64
+}
+
+type stats struct {
+	requests, retries, recovered, failed atomic.Int64
+}
+
+// Stats returns the request counters of the client since it was created.
+func (c *Client) Stats() Stats {
+	return Stats{
+		Requests:  c.stats.requests.Load(),
+		Retries:   c.stats.retries.Load(),
+		Recovered: c.stats.recovered.Load(),
+		Failed:    c.stats.failed.Load(),
+	}
+}
+
+// sleep waits for the duration, or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return requestError(ctx, ctx.Err())
+	case <-t.C:
+		return nil
+	}
+}
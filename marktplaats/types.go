@@ -1,25 +1,63 @@
 package marktplaats
 
 import (
+	"fmt"
 	"net/url"
 	"strconv"
 	"time"
+
+	"encore.dev/beta/errs"
 )
 
 type QueryRequest struct {
-	Query              string `mapstructure:"q"`
-	PostCode           string `mapstructure:"postcode"`
-	DistanceMeters     int    `mapstructure:"distanceMeters"`
-	AttributesByID     []int  `mapstructure:"f"`
-	Category           int    `mapstructure:"category"`
-	SubCategory        int    `mapstructure:"sub_category"`
+	Query          string
+	PostCode       string
+	DistanceMeters int
+	AttributesByID []int
+	Category       int
+	SubCategory    int
+	PriceFromCents int
+	PriceToCents   int
+	// AttributeRanges selects listings with numeric attributes within a range,
+	// for example a construction year from 2010. The price range is set with
+	// PriceFromCents and PriceToCents instead.
+	AttributeRanges []AttributeRange
+	// AttributesByKey selects listings by the value of attributes that are
+	// addressed by key rather than id, for example offeredSince:Gisteren.
+	AttributesByKey    []AttributeValue
 	Limit              int
 	Offset             int
 	IncludeCommercials bool
 }
 
-func (qr QueryRequest) url() (string, error) {
-	uri, err := url.Parse(baseURL)
+// AttributeRange selects listings with a numeric attribute within a range. A
+// bound of zero or less is unbounded.
+type AttributeRange struct {
+	Key  string
+	From int
+	To   int
+}
+
+func (r AttributeRange) String() string {
+	return r.Key + ":" + rangeBound(r.From) + ":" + rangeBound(r.To)
+}
+
+// AttributeValue selects listings with the value for an attribute.
+type AttributeValue struct {
+	Key   string
+	Value string
+}
+
+func (v AttributeValue) String() string {
+	return v.Key + ":" + v.Value
+}
+
+// DefaultLimit is the number of listings requested when QueryRequest.Limit is not set.
+const DefaultLimit = 30
+
+// url returns the search API url for the request.
+func (qr QueryRequest) url(searchURL string) (string, error) {
+	uri, err := url.Parse(searchURL)
 	if err != nil {
 		return "", err
 	}
@@ -27,7 +65,7 @@ func (qr QueryRequest) url() (string, error) {
 	params := url.Values{}
 	params.Add("searchInTitleAndDescription", "true")
 	params.Add("viewOptions", "list-view")
-	limit := 30
+	limit := DefaultLimit
 	if qr.Limit > 0 {
 		limit = qr.Limit
 	}
@@ -55,17 +93,78 @@ func (qr QueryRequest) url() (string, error) {
 	for _, attr := range qr.AttributesByID {
 		params.Add("attributesById[]", strconv.Itoa(attr))
 	}
+	for _, attr := range qr.AttributesByKey {
+		params.Add("attributesByKey[]", attr.String())
+	}
+	if qr.PriceFromCents > 0 || qr.PriceToCents > 0 {
+		params.Add("attributeRanges[]", AttributeRange{Key: priceAttribute, From: qr.PriceFromCents, To: qr.PriceToCents}.String())
+	}
+	for _, r := range qr.AttributeRanges {
+		params.Add("attributeRanges[]", r.String())
+	}
 
 	uri.RawQuery = params.Encode()
 	return uri.String(), nil
 }
 
+// priceAttribute is the key of the price range attribute.
+const priceAttribute = "PriceCents"
+
+// rangeBound formats one end of an attribute range, where an unset bound is sent as null.
+func rangeBound(v int) string {
+	if v <= 0 {
+		return "null"
+	}
+	return strconv.Itoa(v)
+}
+
+// inPriceRange reports whether the price lies within the requested price range.
+func (qr QueryRequest) inPriceRange(priceCents int) bool {
+	if qr.PriceFromCents > 0 && priceCents < qr.PriceFromCents {
+		return false
+	}
+	if qr.PriceToCents > 0 && priceCents > qr.PriceToCents {
+		return false
+	}
+	return true
+}
+
 func (qr QueryRequest) Validate() error {
+	invalid := func(format string, args ...interface{}) error {
+		return &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf(format, args...)}
+	}
+	// an invalid price range silently filters out every listing
+	switch {
+	case qr.PriceFromCents < 0 || qr.PriceToCents < 0:
+		return invalid("the price range can't be negative")
+	case qr.PriceFromCents > 0 && qr.PriceToCents > 0 && qr.PriceFromCents > qr.PriceToCents:
+		return invalid("the price range starts after it ends")
+	}
+	for _, r := range qr.AttributeRanges {
+		switch {
+		case r.Key == "":
+			return invalid("attribute range without a key")
+		case r.Key == priceAttribute:
+			return invalid("the price range is set with the price from and to")
+		case r.From <= 0 && r.To <= 0:
+			return invalid("attribute range %s has no bounds", r.Key)
+		case r.From > 0 && r.To > 0 && r.From > r.To:
+			return invalid("attribute range %s starts after it ends", r.Key)
+		}
+	}
+	for _, v := range qr.AttributesByKey {
+		if v.Key == "" || v.Value == "" {
+			return invalid("attribute %q must have a key and a value", v.String())
+		}
+	}
 	return nil
 }
 
 type QueryResponse struct {
 	Advertisements []Advertisement `json:"advertisements"`
+	// TotalResultCount is the total number of listings matching the query upstream,
+	// before pagination and client side filtering.
+	TotalResultCount int `json:"totalResultCount"`
 }
 
 type Location struct {
@@ -85,4 +184,6 @@ type Advertisement struct {
 
 type PriceInfo struct {
 	PriceCents int
+	// PriceType is how the price is offered, for example FIXED, FAST_BID or SEE_DESCRIPTION.
+	PriceType string
 }
@@ -0,0 +1,286 @@
+package notifications
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/url"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+	"github.com/samber/lo"
+)
+
+type ChannelType string
+
+const (
+	// ChannelNtfy publishes to a topic on a ntfy server.
+	ChannelNtfy ChannelType = "ntfy"
+	// ChannelWebhook posts the notification as JSON to an HTTP endpoint.
+	ChannelWebhook ChannelType = "webhook"
+	// ChannelEmail forwards the notification to an email address, through a
+	// private ntfy topic of the channel.
+	ChannelEmail ChannelType = "email"
+)
+
+// defaultNtfyServer is used for ntfy channels without a server URL and to forward emails.
+const defaultNtfyServer = "https://ntfy.sh"
+
+type Channel struct {
+	ID      string
+	OwnerID string
+	Type    ChannelType
+	Name    string
+	// ServerURL, Topic and Token configure a ntfy channel,
+	// the server defaults to https://ntfy.sh and the token is optional.
+	ServerURL string
+	Topic     string
+	Token     string
+	// WebhookURL is the endpoint of a webhook channel.
+	WebhookURL string
+	// Email is the address of an email channel. The topic of an email channel
+	// is generated, nobody else can guess it and read the notifications.
+	Email string
+}
+
+type ChannelParams struct {
+	Type       ChannelType
+	Name       string
+	ServerURL  string
+	Topic      string
+	Token      string
+	WebhookURL string
+	Email      string
+}
+
+func (p ChannelParams) Validate() error {
+	invalid := func(msg string) error {
+		return &errs.Error{Code: errs.InvalidArgument, Message: msg}
+	}
+	switch p.Type {
+	case ChannelNtfy:
+		if p.Topic == "" {
+			return invalid("a ntfy channel requires a topic")
+		}
+		if p.ServerURL != "" && !isHTTPURL(p.ServerURL) {
+			return invalid("the ntfy server URL must be an http(s) URL")
+		}
+	case ChannelWebhook:
+		if !isHTTPURL(p.WebhookURL) {
+			return invalid("a webhook channel requires an http(s) URL")
+		}
+	case ChannelEmail:
+		if p.Email == "" {
+			return invalid("an email channel requires an email address")
+		}
+	default:
+		return invalid("unknown channel type " + string(p.Type))
+	}
+	return nil
+}
+
+func isHTTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// CreateChannel registers a new notification channel for the authenticated user.
+//
+//encore:api auth method=POST path=/channels
+func CreateChannel(ctx context.Context, p ChannelParams) (*Channel, error) {
+	uid, err := currentUser()
+	if err != nil {
+		return nil, err
+	}
+	id, err := generateID()
+	if err != nil {
+		return nil, err
+	}
+	c := p.channel(id, string(uid))
+	if c.Type == ChannelEmail {
+		if c.Topic, err = emailTopic(); err != nil {
+			return nil, err
+		}
+	}
+	_, err = sqldb.Exec(ctx, `
+        INSERT INTO notification_channel (id, owner_id, type, name, server_url, topic, token, webhook_url, email)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+    `, c.ID, c.OwnerID, c.Type, c.Name, c.ServerURL, c.Topic, c.Token, c.WebhookURL, c.Email)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetChannel retrieves the notification channel for the id.
+//
+//encore:api auth method=GET path=/channels/:id
+func GetChannel(ctx context.Context, id string) (*Channel, error) {
+	return getOwnedChannel(ctx, id)
+}
+
+// UpdateChannel replaces the configuration of the notification channel for the id.
+//
+//encore:api auth method=PUT path=/channels/:id
+func UpdateChannel(ctx context.Context, id string, p ChannelParams) (*Channel, error) {
+	c, err := getOwnedChannel(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	topic := c.Topic
+	wasEmail := c.Type == ChannelEmail
+	c = p.channel(c.ID, c.OwnerID)
+	if c.Type == ChannelEmail {
+		// the private topic of an email channel is kept
+		c.Topic = topic
+		if !wasEmail || topic == "" {
+			if c.Topic, err = emailTopic(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	_, err = sqldb.Exec(ctx, `
+        UPDATE notification_channel
+        SET type = $2, name = $3, server_url = $4, topic = $5, token = $6, webhook_url = $7, email = $8
+        WHERE id = $1
+    `, c.ID, c.Type, c.Name, c.ServerURL, c.Topic, c.Token, c.WebhookURL, c.Email)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// DeleteChannel deletes the notification channel for the id.
+//
+//encore:api auth method=DELETE path=/channels/:id
+func DeleteChannel(ctx context.Context, id string) error {
+	if _, err := getOwnedChannel(ctx, id); err != nil {
+		return err
+	}
+	_, err := sqldb.Exec(ctx, "DELETE FROM notification_channel WHERE id=$1", id)
+	return err
+}
+
+type ListChannelsResult struct {
+	Channels []Channel
+}
+
+// ListChannels lists the notification channels of the authenticated user.
+//
+//encore:api auth method=GET path=/channels
+func ListChannels(ctx context.Context) (*ListChannelsResult, error) {
+	uid, err := currentUser()
+	if err != nil {
+		return nil, err
+	}
+	channels, err := listChannels(ctx, string(uid))
+	if err != nil {
+		return nil, err
+	}
+	return &ListChannelsResult{Channels: channels}, nil
+}
+
+func (p ChannelParams) channel(id, ownerID string) *Channel {
+	return &Channel{
+		ID:         id,
+		OwnerID:    ownerID,
+		Type:       p.Type,
+		Name:       p.Name,
+		ServerURL:  p.ServerURL,
+		Topic:      p.Topic,
+		Token:      p.Token,
+		WebhookURL: p.WebhookURL,
+		Email:      p.Email,
+	}
+}
+
+const channelColumns = "id, owner_id, type, name, server_url, topic, token, webhook_url, email"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanChannel(row scanner) (*Channel, error) {
+	c := &Channel{}
+	err := row.Scan(&c.ID, &c.OwnerID, &c.Type, &c.Name, &c.ServerURL, &c.Topic, &c.Token, &c.WebhookURL, &c.Email)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func listChannels(ctx context.Context, ownerID string) ([]Channel, error) {
+	rows, err := sqldb.Query(ctx, "SELECT "+channelColumns+" FROM notification_channel WHERE owner_id = $1", ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var channels []Channel
+	for rows.Next() {
+		c, err := scanChannel(rows)
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, *c)
+	}
+	return channels, rows.Err()
+}
+
+// selectChannels returns the channels with one of the ids, or all channels
+// when no ids are given.
+func selectChannels(channels []Channel, ids []string) []Channel {
+	if len(ids) == 0 {
+		return channels
+	}
+	return lo.Filter(channels, func(c Channel, _ int) bool {
+		return lo.Contains(ids, c.ID)
+	})
+}
+
+func getOwnedChannel(ctx context.Context, id string) (*Channel, error) {
+	uid, err := currentUser()
+	if err != nil {
+		return nil, err
+	}
+	c, err := scanChannel(sqldb.QueryRow(ctx, "SELECT "+channelColumns+" FROM notification_channel WHERE id = $1", id))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "channel not found"}
+	} else if err != nil {
+		return nil, err
+	}
+	if c.OwnerID != string(uid) {
+		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "channel belongs to another user"}
+	}
+	return c, nil
+}
+
+// currentUser returns the uid of the authenticated user making the request.
+func currentUser() (auth.UID, error) {
+	uid, ok := auth.UserID()
+	if !ok {
+		return "", &errs.Error{Code: errs.Unauthenticated, Message: "no authenticated user"}
+	}
+	return uid, nil
+}
+
+// emailTopic generates the ntfy topic that forwards the notifications of an
+// email channel. It has enough entropy that nobody can guess and subscribe to it.
+func emailTopic() (string, error) {
+	var data [16]byte
+	if _, err := rand.Read(data[:]); err != nil {
+		return "", err
+	}
+	return "spekkoper-" + base64.RawURLEncoding.EncodeToString(data[:]), nil
+}
+
+// generateID generates a random short ID.
+func generateID() (string, error) {
+	var data [6]byte // 6 bytes of entropy
+	if _, err := rand.Read(data[:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data[:]), nil
+}
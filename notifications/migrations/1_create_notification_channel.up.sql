@@ -0,0 +1,15 @@
+CREATE TABLE notification_channel
+(
+    id          TEXT NOT NULL,
+    owner_id    TEXT NOT NULL,
+    type        TEXT NOT NULL,
+    name        TEXT NOT NULL,
+    server_url  TEXT NOT NULL DEFAULT '',
+    topic       TEXT NOT NULL DEFAULT '',
+    token       TEXT NOT NULL DEFAULT '',
+    webhook_url TEXT NOT NULL DEFAULT '',
+    email       TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX notification_channel_owner_id_idx ON notification_channel (owner_id);
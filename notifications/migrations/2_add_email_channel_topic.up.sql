@@ -0,0 +1,3 @@
+UPDATE notification_channel
+SET topic = 'spekkoper-' || replace(gen_random_uuid()::text, '-', '')
+WHERE type = 'email';
@@ -1,40 +1,247 @@
 package notifications
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 	"time"
 
 	"encore.app/spekkoper"
 	"encore.dev/pubsub"
+	"encore.dev/rlog"
 	"github.com/samber/lo"
 )
 
 var _ = pubsub.NewSubscription(
 	spekkoper.NewAds, "send-new-ad-notification",
 	pubsub.SubscriptionConfig[*spekkoper.NewQueryResultEvent]{
-		Handler: SendWelcomeEmail,
+		Handler: SendNewAdNotification,
+	},
+)
+
+var _ = pubsub.NewSubscription(
+	spekkoper.PriceDropped, "send-price-drop-notification",
+	pubsub.SubscriptionConfig[*spekkoper.PriceDroppedEvent]{
+		Handler: SendPriceDropNotification,
+	},
+)
+
+var _ = pubsub.NewSubscription(
+	spekkoper.QueryFailing, "send-query-failing-notification",
+	pubsub.SubscriptionConfig[*spekkoper.QueryFailingEvent]{
+		Handler: SendQueryFailingNotification,
 	},
 )
 
 var secrets struct {
-	ForwardEmailAddress string // ed25519 private key for SSH server
+	ForwardEmailAddress string // email address notifications are forwarded to when a user has no channels
 }
 
-func SendWelcomeEmail(ctx context.Context, event *spekkoper.NewQueryResultEvent) error {
+// legacyTopic receives the notifications of users without notification channels.
+const legacyTopic = "spekkoper"
+
+// message is a notification rendered independently of the channel it is sent to.
+type message struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	URL   string `json:"url"`
+	// QueryURL opens the search that sent the notification on marktplaats.
+	QueryURL  string   `json:"queryUrl,omitempty"`
+	ImageUrls []string `json:"imageUrls"`
+	Tags      []string `json:"tags"`
+	// Event is the raw event, it is included in webhook payloads.
+	Event interface{} `json:"event"`
+}
+
+func newAdMessage(event *spekkoper.NewQueryResultEvent) message {
+	ad := event.Advertisement
+	title := ad.Title
+	var tags []string
+	if event.QueryLabel != "" {
+		title = fmt.Sprintf("[%s] %s", event.QueryLabel, ad.Title)
+		tags = append(tags, event.QueryLabel)
+	}
+	return message{
+		Title:     title,
+		Body:      fmt.Sprintf("%s\ndatum: %s\nprijs: €%d\n%s", ad.Description, ad.Date.Format(time.RFC3339), ad.PriceInfo.PriceCents/100, ad.Location.CityName),
+		URL:       ad.URL,
+		QueryURL:  event.BrowserURL,
+		ImageUrls: ad.ImageUrls,
+		Tags:      tags,
+		Event:     event,
+	}
+}
+
+func SendNewAdNotification(ctx context.Context, event *spekkoper.NewQueryResultEvent) error {
+	return notify(ctx, event.OwnerID, event.ChannelIDs, newAdMessage(event))
+}
+
+func priceDropMessage(event *spekkoper.PriceDroppedEvent) message {
 	ad := event.Advertisement
+	title := "Prijsdaling: " + ad.Title
+	tags := []string{"chart_with_downwards_trend"}
+	if event.QueryLabel != "" {
+		title = fmt.Sprintf("[%s] %s", event.QueryLabel, title)
+		tags = append(tags, event.QueryLabel)
+	}
+	return message{
+		Title:     title,
+		Body:      fmt.Sprintf("prijs: €%d → €%d (-%.0f%%)\n%s", event.OldPriceCents/100, event.NewPriceCents/100, event.DropPercentage, ad.Location.CityName),
+		URL:       ad.URL,
+		QueryURL:  event.BrowserURL,
+		ImageUrls: ad.ImageUrls,
+		Tags:      tags,
+		Event:     event,
+	}
+}
 
-	body := strings.NewReader(fmt.Sprintf("%s\ndatum:%s\nprijs: €%d\n%s", ad.Date.Format(time.RFC3339), ad.Description, ad.PriceInfo.PriceCents/100, ad.Location.CityName))
+func SendPriceDropNotification(ctx context.Context, event *spekkoper.PriceDroppedEvent) error {
+	return notify(ctx, event.OwnerID, event.ChannelIDs, priceDropMessage(event))
+}
+
+func queryFailingMessage(event *spekkoper.QueryFailingEvent) message {
+	return message{
+		Title: fmt.Sprintf("[%s] Zoekopdracht gepauzeerd", event.QueryLabel),
+		Body:  fmt.Sprintf("de zoekopdracht is %d keer achter elkaar mislukt en wordt niet meer uitgevoerd tot je hem hervat\nlaatste fout: %s", event.ConsecutiveFailures, event.LastError),
+		// there is no advertisement, so the notification opens the search
+		URL:      event.BrowserURL,
+		QueryURL: event.BrowserURL,
+		Tags:     []string{"warning", event.QueryLabel},
+		Event:    event,
+	}
+}
+
+func SendQueryFailingNotification(ctx context.Context, event *spekkoper.QueryFailingEvent) error {
+	return notify(ctx, event.OwnerID, event.ChannelIDs, queryFailingMessage(event))
+}
+
+// notify sends the message to the selected channels of the owner. Only owners
+// without any channels are notified on the legacy topic, the notifications of
+// a query whose selected channels no longer exist are dropped rather than
+// published on a topic anyone can read.
+func notify(ctx context.Context, ownerID string, channelIDs []string, msg message) error {
+	channels, err := listChannels(ctx, ownerID)
+	if err != nil {
+		return err
+	}
+	if len(channels) == 0 {
+		return sendNtfy(ctx, defaultNtfyServer, legacyTopic, "", secrets.ForwardEmailAddress, msg)
+	}
+	selected := selectChannels(channels, channelIDs)
+	if len(selected) == 0 {
+		rlog.Error("none of the selected channels exist, the notification is dropped", "owner", ownerID, "channels", channelIDs)
+		return nil
+	}
+	return sendAll(ctx, selected, msg)
+}
+
+// sendAll sends the message to the channels. A failed delivery is retried by
+// redelivering the event, which sends the message to all channels again, so
+// it only fails when none of the channels received the message.
+func sendAll(ctx context.Context, channels []Channel, msg message) error {
+	var failed error
+	delivered := 0
+	for _, c := range channels {
+		if err := send(ctx, c, msg); err != nil {
+			rlog.Error("could not send notification", "channel", c.ID, "type", c.Type, "err", err)
+			failed = err
+			continue
+		}
+		delivered++
+	}
+	if delivered == 0 {
+		return failed
+	}
+	return nil
+}
 
-	req, _ := http.NewRequest("POST", "https://ntfy.sh/spekkoper", body)
-	req.Header.Set("Click", event.Advertisement.URL)
-	req.Header.Set("X-Title", event.Advertisement.Title)
-	lo.ForEach(event.Advertisement.ImageUrls, func(url string, _ int) {
+func send(ctx context.Context, c Channel, msg message) error {
+	switch c.Type {
+	case ChannelNtfy:
+		server := c.ServerURL
+		if server == "" {
+			server = defaultNtfyServer
+		}
+		return sendNtfy(ctx, server, c.Topic, c.Token, "", msg)
+	case ChannelEmail:
+		// never fall back to a shared topic, anyone could read the notifications there
+		if c.Topic == "" {
+			return fmt.Errorf("email channel %s has no topic", c.ID)
+		}
+		return sendNtfy(ctx, defaultNtfyServer, c.Topic, "", c.Email, msg)
+	case ChannelWebhook:
+		return sendWebhook(ctx, c.WebhookURL, msg)
+	default:
+		return fmt.Errorf("unknown channel type %q", c.Type)
+	}
+}
+
+// sendNtfy publishes the message to the topic on a ntfy server, and
+// lets ntfy forward it to the email address if one is given.
+func sendNtfy(ctx context.Context, server, topic, token, email string, msg message) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(server, "/")+"/"+topic, strings.NewReader(msg.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Click", msg.URL)
+	req.Header.Set("X-Title", msg.Title)
+	lo.ForEach(msg.ImageUrls, func(url string, _ int) {
 		req.Header.Set("Attach", "https:"+url)
 	})
-	req.Header.Set("Email", secrets.ForwardEmailAddress)
-	_, err := http.DefaultClient.Do(req)
-	return err
+	if msg.QueryURL != "" {
+		// the JSON form, the short form splits on the commas in browser URLs
+		actions, err := json.Marshal([]ntfyAction{{Action: "view", Label: "Zoekopdracht", URL: msg.QueryURL}})
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Actions", string(actions))
+	}
+	if len(msg.Tags) > 0 {
+		req.Header.Set("Tags", strings.Join(msg.Tags, ","))
+	}
+	if email != "" {
+		req.Header.Set("Email", email)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return do(req)
+}
+
+// ntfyAction is a button of a ntfy notification.
+type ntfyAction struct {
+	Action string `json:"action"`
+	Label  string `json:"label"`
+	URL    string `json:"url"`
+}
+
+// sendWebhook posts the message as JSON to the webhook URL.
+func sendWebhook(ctx context.Context, webhookURL string, msg message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", webhookURL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return do(req)
+}
+
+func do(req *http.Request) error {
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: unexpected status %s", req.Method, req.URL.Redacted(), res.Status)
+	}
+	return nil
 }
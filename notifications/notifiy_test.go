@@ -0,0 +1,143 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"encore.app/marktplaats"
+	"encore.app/spekkoper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSend(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+	msg := message{
+		Title: "Zibro kachel", Body: "prijs: €50", URL: "https://marktplaats.nl/v/1", ImageUrls: []string{"//img.png"},
+		QueryURL: "https://www.marktplaats.nl/l/huis-en-inrichting/kachels/q/zibro/#f:31,32|postcode:3461CC",
+	}
+	ctx := context.TODO()
+
+	t.Run("ntfy", func(t *testing.T) {
+		err := send(ctx, Channel{Type: ChannelNtfy, ServerURL: srv.URL, Topic: "kachels", Token: "secret"}, msg)
+		assert.NoError(t, err)
+		assert.Equal(t, "/kachels", got.URL.Path)
+		assert.Equal(t, "Bearer secret", got.Header.Get("Authorization"))
+		assert.Equal(t, "Zibro kachel", got.Header.Get("X-Title"))
+		assert.Equal(t, "https://img.png", got.Header.Get("Attach"))
+		var actions []ntfyAction
+		assert.NoError(t, json.Unmarshal([]byte(got.Header.Get("Actions")), &actions))
+		assert.Equal(t, []ntfyAction{{Action: "view", Label: "Zoekopdracht", URL: msg.QueryURL}}, actions)
+		assert.Equal(t, "prijs: €50", string(body))
+	})
+	t.Run("webhook", func(t *testing.T) {
+		err := send(ctx, Channel{Type: ChannelWebhook, WebhookURL: srv.URL + "/hook"}, msg)
+		assert.NoError(t, err)
+		assert.Equal(t, "/hook", got.URL.Path)
+		var payload message
+		assert.NoError(t, json.Unmarshal(body, &payload))
+		assert.Equal(t, msg.Title, payload.Title)
+		assert.Equal(t, msg.URL, payload.URL)
+		assert.Equal(t, msg.QueryURL, payload.QueryURL)
+	})
+	t.Run("failing endpoint", func(t *testing.T) {
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}))
+		defer failing.Close()
+		err := send(ctx, Channel{Type: ChannelWebhook, WebhookURL: failing.URL}, msg)
+		assert.Error(t, err)
+
+		// the message is not sent again to the channels that received it
+		ok := Channel{Type: ChannelWebhook, WebhookURL: srv.URL + "/hook"}
+		broken := Channel{Type: ChannelWebhook, WebhookURL: failing.URL}
+		assert.NoError(t, sendAll(ctx, []Channel{broken, ok}, msg))
+		assert.Error(t, sendAll(ctx, []Channel{broken, broken}, msg))
+	})
+}
+
+func TestEmailTopic(t *testing.T) {
+	a, err := emailTopic()
+	assert.NoError(t, err)
+	b, err := emailTopic()
+	assert.NoError(t, err)
+	assert.NotEqual(t, a, b)
+	assert.NotEqual(t, legacyTopic, a)
+	assert.Greater(t, len(a), 20)
+
+	err = send(context.TODO(), Channel{ID: "c1", Type: ChannelEmail, Email: "me@example.com"}, message{})
+	assert.Error(t, err)
+}
+
+func TestSelectChannels(t *testing.T) {
+	channels := []Channel{{ID: "a"}, {ID: "b"}}
+	assert.Equal(t, channels, selectChannels(channels, nil))
+	assert.Equal(t, []Channel{{ID: "b"}}, selectChannels(channels, []string{"b", "deleted"}))
+	assert.Empty(t, selectChannels(channels, []string{"deleted"}))
+}
+
+func TestChannelParamsValidate(t *testing.T) {
+	assert.NoError(t, ChannelParams{Type: ChannelNtfy, Topic: "kachels"}.Validate())
+	assert.Error(t, ChannelParams{Type: ChannelNtfy}.Validate())
+	assert.NoError(t, ChannelParams{Type: ChannelWebhook, WebhookURL: "https://example.com/hook"}.Validate())
+	assert.Error(t, ChannelParams{Type: ChannelWebhook, WebhookURL: "example.com"}.Validate())
+	assert.NoError(t, ChannelParams{Type: ChannelEmail, Email: "me@example.com"}.Validate())
+	assert.Error(t, ChannelParams{Type: "sms"}.Validate())
+}
+
+func TestNewAdMessage(t *testing.T) {
+	event := &spekkoper.NewQueryResultEvent{
+		QueryID:    "q1",
+		OwnerID:    "alice",
+		QueryLabel: "kachel Zibro",
+		MatchedAt:  time.Now(),
+		BrowserURL: "https://www.marktplaats.nl/q/zibro/",
+		Advertisement: marktplaats.Advertisement{
+			Title:       "Zibro LC-30",
+			Description: "werkt prima",
+			PriceInfo:   marktplaats.PriceInfo{PriceCents: 5000},
+			Location:    marktplaats.Location{CityName: "Ede"},
+		},
+	}
+	msg := newAdMessage(event)
+	assert.Equal(t, "[kachel Zibro] Zibro LC-30", msg.Title)
+	assert.Equal(t, []string{"kachel Zibro"}, msg.Tags)
+	assert.Contains(t, msg.Body, "prijs: €50")
+	assert.Contains(t, msg.Body, "werkt prima")
+	assert.Equal(t, event.BrowserURL, msg.QueryURL)
+}
+
+func TestPriceDropMessage(t *testing.T) {
+	msg := priceDropMessage(&spekkoper.PriceDroppedEvent{
+		QueryLabel:     "kachel Zibro",
+		Advertisement:  marktplaats.Advertisement{Title: "Zibro LC-30"},
+		OldPriceCents:  25000,
+		NewPriceCents:  15000,
+		DropPercentage: 40,
+	})
+	assert.Equal(t, "[kachel Zibro] Prijsdaling: Zibro LC-30", msg.Title)
+	assert.Contains(t, msg.Body, "€250 → €150 (-40%)")
+}
+
+func TestQueryFailingMessage(t *testing.T) {
+	msg := queryFailingMessage(&spekkoper.QueryFailingEvent{
+		QueryLabel:          "kachel Zibro",
+		ConsecutiveFailures: 10,
+		LastError:           "unknown category",
+		BrowserURL:          "https://www.marktplaats.nl/q/zibro/",
+	})
+	assert.Equal(t, "[kachel Zibro] Zoekopdracht gepauzeerd", msg.Title)
+	assert.Contains(t, msg.Body, "10 keer")
+	assert.Contains(t, msg.Body, "unknown category")
+	assert.Equal(t, "https://www.marktplaats.nl/q/zibro/", msg.URL)
+}
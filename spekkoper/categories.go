@@ -0,0 +1,245 @@
+package spekkoper
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.app/marktplaats"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+	"github.com/samber/lo"
+)
+
+// Periodically refresh the marktplaats categories. They rarely change, but the
+// job runs often so they are stored soon after a fresh deploy.
+var _ = cron.NewJob("refresh-categories", cron.JobConfig{
+	Title:    "Refresh the marktplaats categories",
+	Every:    10 * cron.Minute,
+	Endpoint: RefreshCategories,
+})
+
+// categoriesMaxAge is the time after which the stored categories are refreshed.
+const categoriesMaxAge = 24 * time.Hour
+
+// RefreshCategories retrieves the marktplaats categories and stores them, when
+// none are stored or they are older than categoriesMaxAge. Categories that
+// marktplaats no longer offers are removed.
+//
+//encore:api private
+func RefreshCategories(ctx context.Context) error {
+	var stored int
+	var updatedAt *time.Time
+	if err := sqldb.QueryRow(ctx, "SELECT count(*), min(updated_at) FROM category").Scan(&stored, &updatedAt); err != nil {
+		return err
+	}
+	if stored > 0 && updatedAt != nil && time.Since(*updatedAt) < categoriesMaxAge {
+		return nil
+	}
+	categories, err := client.Categories(ctx)
+	if err != nil {
+		return err
+	}
+	if len(categories) == 0 {
+		// an empty answer is more likely an upstream change than marktplaats without categories
+		return &errs.Error{Code: errs.Internal, Message: "marktplaats did not return any categories"}
+	}
+	return storeCategories(ctx, categories)
+}
+
+// storeCategories replaces the stored categories.
+func storeCategories(ctx context.Context, categories []marktplaats.Category) error {
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// a no-op once the transaction is committed
+		_ = tx.Rollback()
+	}()
+
+	ids := make([]int, 0, len(categories))
+	for _, c := range categories {
+		var parentID *int
+		if c.ParentID != 0 {
+			parentID = &c.ParentID
+		}
+		_, err := tx.Exec(ctx, `
+            INSERT INTO category (id, key, name, full_name, parent_id, updated_at)
+            VALUES ($1, $2, $3, $4, $5, now())
+            ON CONFLICT (id) DO UPDATE
+            SET key = excluded.key, name = excluded.name, full_name = excluded.full_name,
+                parent_id = excluded.parent_id, updated_at = excluded.updated_at
+        `, c.ID, c.Key, c.Name, c.FullName, parentID)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, c.ID)
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM category WHERE NOT (id = ANY($1))", ids); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return errs.Wrap(err, "could not store the categories")
+	}
+	rlog.Info("stored marktplaats categories", "count", len(categories))
+	return nil
+}
+
+// storedCategories returns the stored categories ordered by id.
+func storedCategories(ctx context.Context) ([]marktplaats.Category, error) {
+	rows, err := sqldb.Query(ctx, `
+        SELECT id, key, name, full_name, COALESCE(parent_id, 0)
+        FROM category
+        ORDER BY id
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []marktplaats.Category
+	for rows.Next() {
+		var c marktplaats.Category
+		if err := rows.Scan(&c.ID, &c.Key, &c.Name, &c.FullName, &c.ParentID); err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+// taxonomy returns the stored categories. Until they are stored by the
+// refresh-categories job, for example right after a fresh deploy, the small
+// snapshot of the marktplaats package is used. Request handlers never retrieve
+// the categories from marktplaats themselves.
+func taxonomy(ctx context.Context) (*marktplaats.Taxonomy, error) {
+	categories, err := storedCategories(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(categories) == 0 {
+		return marktplaats.SnapshotTaxonomy(), nil
+	}
+	return marktplaats.NewTaxonomy(categories), nil
+}
+
+// browserURL returns the URL that opens the search of the query on
+// marktplaats. It is empty when the category of the query no longer exists.
+func browserURL(categories *marktplaats.Taxonomy, q *Query) string {
+	u, err := q.searchRequest(RunParams{}).BrowserURL(categories)
+	if err != nil {
+		rlog.Error("could not generate browser url", "query", q.ID, "err", err)
+		return ""
+	}
+	return u
+}
+
+// queryBrowserURL returns the browser URL of the query for the events of the
+// query, an error only leaves it out of the notifications.
+func queryBrowserURL(ctx context.Context, q *Query) string {
+	categories, err := taxonomy(ctx)
+	if err != nil {
+		rlog.Error("could not retrieve categories", "query", q.ID, "err", err)
+		return ""
+	}
+	return browserURL(categories, q)
+}
+
+type ListCategoriesParams struct {
+	// ParentID lists the subcategories of the category, when not set the top
+	// level categories are listed.
+	ParentID int
+}
+
+type ListCategoriesResponse struct {
+	Categories []marktplaats.Category
+}
+
+// ListCategories lists the marktplaats categories, to find the categories to search in.
+//
+//encore:api auth method=GET path=/categories
+func ListCategories(ctx context.Context, p ListCategoriesParams) (*ListCategoriesResponse, error) {
+	t, err := taxonomy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := t.Category(p.ParentID); p.ParentID != 0 && !ok {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "category not found"}
+	}
+	res := &ListCategoriesResponse{Categories: []marktplaats.Category{}}
+	for _, c := range t.Categories() {
+		if c.ParentID == p.ParentID {
+			res.Categories = append(res.Categories, c)
+		}
+	}
+	return res, nil
+}
+
+type CategoryAttributesResponse struct {
+	Attributes []marktplaats.Attribute
+}
+
+// CategoryAttributes lists the attributes advertisements in the category can
+// be filtered on, with the number of advertisements for every value.
+//
+//encore:api auth method=GET path=/categories/:id/attributes
+func CategoryAttributes(ctx context.Context, id int) (*CategoryAttributesResponse, error) {
+	category, sub, err := categoryPair(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	attributes, err := client.Attributes(ctx, category, sub)
+	if err != nil {
+		return nil, err
+	}
+	return &CategoryAttributesResponse{Attributes: attributes}, nil
+}
+
+// categoryPair returns the top level category and subcategory to search for
+// the category with the id.
+func categoryPair(ctx context.Context, id int) (category, sub int, err error) {
+	t, err := taxonomy(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	c, ok := t.Category(id)
+	if !ok {
+		return 0, 0, &errs.Error{Code: errs.NotFound, Message: "category not found"}
+	}
+	if c.ParentID != 0 {
+		return c.ParentID, c.ID, nil
+	}
+	return c.ID, 0, nil
+}
+
+// resolveAttributes adds the attributes, written as key=value, to the filters
+// of the query. Attributes with an id are added to AttributesByID, the others
+// to AttributesByKey.
+func resolveAttributes(ctx context.Context, q *Query, attributes []string) error {
+	available, err := client.Attributes(ctx, q.Category, q.SubCategory)
+	if err != nil {
+		return err
+	}
+	for _, a := range attributes {
+		key, value, ok := strings.Cut(a, "=")
+		if !ok {
+			return &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("attribute %q must be written as key=value", a)}
+		}
+		attribute, option, err := marktplaats.ResolveAttribute(available, strings.TrimSpace(key), value)
+		if err != nil {
+			return err
+		}
+		if option.ID != 0 {
+			if !lo.Contains(q.AttributesByID, option.ID) {
+				q.AttributesByID = append(q.AttributesByID, option.ID)
+			}
+			continue
+		}
+		q.AttributesByKey = append(q.AttributesByKey, marktplaats.AttributeValue{Key: attribute.Key, Value: option.Key})
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package spekkoper
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"encore.app/marktplaats"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+// Periodically check all registered queries for new advertisements
+var _ = cron.NewJob("run-all-registered-queries", cron.JobConfig{
+	Title:    "Run all registered queries",
+	Every:    1 * cron.Minute,
+	Endpoint: CheckAll,
+})
+
+const (
+	// rateLimitBackoff is used when marktplaats rate limits without a Retry-After header.
+	rateLimitBackoff = 5 * time.Minute
+	// blockedBackoff pauses all queries after marktplaats blocked our requests.
+	blockedBackoff = 30 * time.Minute
+)
+
+// spreadWindow is the part of the cron interval over which the registered
+// queries are spread, so marktplaats doesn't get a burst of requests at the
+// top of every minute.
+var spreadWindow = 45 * time.Second
+
+// spreadOffsets returns a random start offset within the window for each of n queries.
+// The window is divided in n equal slots, every query starts at a random moment in its slot.
+func spreadOffsets(n int, window time.Duration) []time.Duration {
+	offsets := make([]time.Duration, n)
+	if n == 0 || window <= 0 {
+		return offsets
+	}
+	slot := window / time.Duration(n)
+	for i := range offsets {
+		offsets[i] = time.Duration(i)*slot + time.Duration(rand.Int63n(int64(slot)+1))
+	}
+	return offsets
+}
+
+// upstreamBackoff is the time until which no queries are run, because marktplaats
+// asked us to back off.
+var upstreamBackoff struct {
+	sync.Mutex
+	until time.Time
+}
+
+func backoffUntil() time.Time {
+	upstreamBackoff.Lock()
+	defer upstreamBackoff.Unlock()
+	return upstreamBackoff.until
+}
+
+func backoff(d time.Duration) {
+	upstreamBackoff.Lock()
+	defer upstreamBackoff.Unlock()
+	if until := time.Now().Add(d); until.After(upstreamBackoff.until) {
+		upstreamBackoff.until = until
+	}
+}
+
+const (
+	// maxConcurrentQueries bounds the number of queries that run at the same time.
+	maxConcurrentQueries = 4
+	// queryTimeout bounds a single run of a query.
+	queryTimeout = 30 * time.Second
+	// queryLease is how long a run claims a query, it expires in case the run
+	// crashes before releasing it.
+	queryLease = 2 * time.Minute
+)
+
+type CheckAllResult struct {
+	Succeeded int
+	Failed    int
+	// Skipped counts the due queries that were not run, because another run
+	// claimed them, they are outside their active hours, or because
+	// marktplaats asked us to back off.
+	Skipped  int
+	Failures []QueryFailure
+}
+
+type QueryFailure struct {
+	QueryID string
+	Error   string
+}
+
+type checkOutcome int
+
+const (
+	checkSucceeded checkOutcome = iota
+	checkFailed
+	checkSkipped
+)
+
+func (r *CheckAllResult) record(queryID string, outcome checkOutcome, err error) {
+	switch outcome {
+	case checkSucceeded:
+		r.Succeeded++
+	case checkFailed:
+		r.Failed++
+		r.Failures = append(r.Failures, QueryFailure{QueryID: queryID, Error: err.Error()})
+	case checkSkipped:
+		r.Skipped++
+	}
+}
+
+// CheckAll runs the registered queries that are due, spread over the cron
+// interval, using a bounded number of concurrent workers.
+//
+//encore:api private
+func CheckAll(ctx context.Context) (*CheckAllResult, error) {
+	srv :=
+		&Service{
+			marktplaats: client,
+		}
+	queries, err := getDueQueries(ctx)
+	if err != nil {
+		return nil, errs.Wrap(err, "failed to list the due registered queries")
+	}
+	res := &CheckAllResult{}
+	if until := backoffUntil(); time.Now().Before(until) {
+		rlog.Info("backing off from marktplaats, skipping registered queries", "until", until)
+		res.Skipped = len(queries)
+		return res, nil
+	}
+	rand.Shuffle(len(queries), func(i, j int) {
+		queries[i], queries[j] = queries[j], queries[i]
+	})
+
+	type job struct {
+		query Query
+		at    time.Time
+	}
+	jobs := make(chan job)
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		stop atomic.Bool
+	)
+	for w := 0; w < maxConcurrentQueries; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				outcome, err := srv.check(ctx, j.query, j.at, &stop)
+				mu.Lock()
+				res.record(j.query.ID, outcome, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	start := time.Now()
+	offsets := spreadOffsets(len(queries), spreadWindow)
+	for i, q := range queries {
+		jobs <- job{query: q, at: start.Add(offsets[i])}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return res, errs.Wrap(err, "stopped running registered queries")
+	}
+	rlog.Info("ran registered queries", "succeeded", res.Succeeded, "failed", res.Failed, "skipped", res.Skipped)
+	return res, nil
+}
+
+// check runs a registered query at its start time, unless the remaining
+// queries are stopped, another run claimed the query or it is outside its
+// active hours. It schedules the next run of the query.
+func (srv *Service) check(ctx context.Context, q Query, at time.Time, stop *atomic.Bool) (checkOutcome, error) {
+	if wait := time.Until(at); wait > 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+	}
+	if ctx.Err() != nil || stop.Load() {
+		return checkSkipped, nil
+	}
+	claimed, err := claimQuery(ctx, q.ID)
+	if err != nil {
+		rlog.Error("could not claim query", "query", q.ID, "err", err)
+		return checkFailed, err
+	}
+	if !claimed {
+		return checkSkipped, nil
+	}
+	defer releaseQuery(ctx, q.ID)
+
+	startedAt := time.Now()
+	if !q.activeAt(startedAt) {
+		// the query became due outside its active hours, for example after its
+		// schedule changed, so it is postponed until they start
+		scheduleRun(ctx, q.ID, q.LastRunAt, q.nextActive(startedAt))
+		return checkSkipped, nil
+	}
+	// the next run is scheduled even if this one fails, so a failing query is
+	// not retried every minute
+	defer scheduleRun(ctx, q.ID, &startedAt, q.nextRun(startedAt))
+
+	runCtx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	if _, err := srv.runAndRecord(runCtx, q.ID, RunParams{DeepScan: true}); err != nil {
+		if skipRemaining := handleRunError(q.ID, err); skipRemaining {
+			// marktplaats fails for all queries, it is not the query that is broken
+			stop.Store(true)
+		} else {
+			pauseIfFailing(ctx, q, err)
+		}
+		return checkFailed, err
+	}
+	return checkSucceeded, nil
+}
+
+// claimQuery leases the query to the current run, so overlapping runs of
+// CheckAll don't run it twice. It reports false if the query is leased
+// already, or is no longer due because a run that overlapped with this one
+// ran it or it was paused meanwhile.
+func claimQuery(ctx context.Context, id string) (bool, error) {
+	res, err := sqldb.Exec(ctx, `
+        UPDATE query SET lease_until = now() + $2 * interval '1 second'
+        WHERE id = $1 AND (lease_until IS NULL OR lease_until < now())
+          AND paused_at IS NULL AND (next_run_at IS NULL OR next_run_at <= now())
+    `, id, queryLease.Seconds())
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() == 1, nil
+}
+
+// releaseQuery ends the lease of the current run on the query.
+func releaseQuery(ctx context.Context, id string) {
+	if _, err := sqldb.Exec(ctx, "UPDATE query SET lease_until = NULL WHERE id = $1", id); err != nil {
+		rlog.Error("could not release query", "query", id, "err", err)
+	}
+}
+
+// scheduleRun records the last run of the query and when it is due again.
+func scheduleRun(ctx context.Context, id string, lastRunAt *time.Time, nextRunAt time.Time) {
+	_, err := sqldb.Exec(ctx, "UPDATE query SET last_run_at = $2, next_run_at = $3 WHERE id = $1", id, lastRunAt, nextRunAt)
+	if err != nil {
+		rlog.Error("could not schedule query", "query", id, "err", err)
+	}
+}
+
+// handleRunError reports the failure to run a query and reports whether the
+// remaining queries should be skipped.
+func handleRunError(queryID string, err error) bool {
+	upstream, ok := marktplaats.UpstreamErrorOf(err)
+	if !ok {
+		rlog.Error("could not run query", "query", queryID, "err", err)
+		return false
+	}
+	switch upstream.Kind {
+	case marktplaats.ErrRateLimited:
+		d := upstream.RetryAfter
+		if d <= 0 {
+			d = rateLimitBackoff
+		}
+		backoff(d)
+		rlog.Info("marktplaats is rate limiting, backing off", "query", queryID, "backoff", d)
+		return true
+	case marktplaats.ErrBlocked:
+		backoff(blockedBackoff)
+		rlog.Error("ALERT: marktplaats is blocking our requests, backing off", "query", queryID, "backoff", blockedBackoff, "err", err)
+		return true
+	case marktplaats.ErrSchemaChanged:
+		rlog.Error("ALERT: could not understand the marktplaats response, skipping query", "query", queryID, "err", err)
+		return false
+	default:
+		rlog.Error("marktplaats failed to run the query, skipping it", "query", queryID, "err", err)
+		return false
+	}
+}
+
+// UpstreamStats reports the requests made to marktplaats since the service started,
+// including how many of them were retried.
+//
+//encore:api auth method=GET path=/marktplaats/stats
+func UpstreamStats(ctx context.Context) (*marktplaats.Stats, error) {
+	stats := client.Stats()
+	return &stats, nil
+}
+
+// getDueQueries returns the registered queries that are due to run, queries
+// that never ran are due immediately. Paused queries are never due.
+func getDueQueries(ctx context.Context) ([]Query, error) {
+	rows, err := sqldb.Query(ctx, `
+        SELECT `+queryColumns+` FROM query
+        WHERE paused_at IS NULL AND (next_run_at IS NULL OR next_run_at <= now())
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var queries []Query
+
+	for rows.Next() {
+		u, err := scanQuery(rows)
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, *u)
+	}
+	return queries, rows.Err()
+}
@@ -0,0 +1,76 @@
+package spekkoper
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"encore.app/marktplaats"
+	"encore.dev/beta/errs"
+)
+
+// keywordMatcher matches a single keyword rule against the text of an advertisement.
+// Rules are matched case-insensitively as plain text, unless they are written
+// as /expression/ in which case they are interpreted as a regular expression.
+type keywordMatcher func(text string) bool
+
+func compileKeyword(rule string) (keywordMatcher, error) {
+	if len(rule) > 2 && strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/") {
+		re, err := regexp.Compile("(?i)" + rule[1:len(rule)-1])
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+	keyword := strings.ToLower(rule)
+	return func(text string) bool {
+		return strings.Contains(text, keyword)
+	}, nil
+}
+
+func compileKeywords(rules []string) ([]keywordMatcher, error) {
+	matchers := make([]keywordMatcher, 0, len(rules))
+	for _, rule := range rules {
+		m, err := compileKeyword(rule)
+		if err != nil {
+			return nil, &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("invalid keyword rule %q: %v", rule, err)}
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+// adFilter decides whether an advertisement passes the keyword rules of a query.
+type adFilter struct {
+	exclude []keywordMatcher
+	require []keywordMatcher
+}
+
+func newAdFilter(q Query) (*adFilter, error) {
+	exclude, err := compileKeywords(q.ExcludeKeywords)
+	if err != nil {
+		return nil, err
+	}
+	require, err := compileKeywords(q.RequireKeywords)
+	if err != nil {
+		return nil, err
+	}
+	return &adFilter{exclude: exclude, require: require}, nil
+}
+
+// Match reports whether the advertisement contains none of the excluded
+// keywords and all of the required keywords in its title or description.
+func (f *adFilter) Match(ad marktplaats.Advertisement) bool {
+	text := strings.ToLower(ad.Title + "\n" + ad.Description)
+	for _, m := range f.exclude {
+		if m(text) {
+			return false
+		}
+	}
+	for _, m := range f.require {
+		if !m(text) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,12 @@
+CREATE TABLE price_history
+(
+    query_id    TEXT NOT NULL,
+    result_id   TEXT NOT NULL,
+    price_cents INT  NOT NULL,
+    observed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    CONSTRAINT fk_query_result
+        FOREIGN KEY (query_id, result_id)
+            REFERENCES query_result (query_id, result_id)
+);
+
+CREATE INDEX price_history_result_idx ON price_history (query_id, result_id, observed_at);
@@ -0,0 +1,2 @@
+ALTER TABLE price_history
+    ADD COLUMN price_type TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,5 @@
+ALTER TABLE query_result
+    ADD COLUMN first_seen_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    ADD COLUMN posted_at     TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX query_result_first_seen_at_idx ON query_result (query_id, first_seen_at);
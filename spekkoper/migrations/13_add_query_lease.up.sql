@@ -0,0 +1,2 @@
+ALTER TABLE query
+    ADD COLUMN lease_until TIMESTAMP WITH TIME ZONE;
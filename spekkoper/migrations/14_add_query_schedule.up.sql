@@ -0,0 +1,9 @@
+ALTER TABLE query
+    ADD COLUMN check_interval_minutes INT NOT NULL DEFAULT 0,
+    ADD COLUMN active_from_hour       INT NOT NULL DEFAULT 0,
+    ADD COLUMN active_until_hour      INT NOT NULL DEFAULT 0,
+    ADD COLUMN active_days            INT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN last_run_at            TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN next_run_at            TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX query_next_run_at_idx ON query (next_run_at);
@@ -0,0 +1,13 @@
+CREATE TABLE query_run
+(
+    id            BIGSERIAL PRIMARY KEY,
+    query_id      TEXT                     NOT NULL,
+    started_at    TIMESTAMP WITH TIME ZONE NOT NULL,
+    finished_at   TIMESTAMP WITH TIME ZONE NOT NULL,
+    results       INT                      NOT NULL DEFAULT 0,
+    new_results   INT                      NOT NULL DEFAULT 0,
+    error_code    TEXT                     NOT NULL DEFAULT '',
+    error_message TEXT                     NOT NULL DEFAULT ''
+);
+
+CREATE INDEX query_run_query_idx ON query_run (query_id, started_at);
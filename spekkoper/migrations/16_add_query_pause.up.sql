@@ -0,0 +1,5 @@
+ALTER TABLE query
+    ADD COLUMN pause_after_failures INT  NOT NULL DEFAULT 0,
+    ADD COLUMN paused_at            TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN pause_reason         TEXT NOT NULL DEFAULT '',
+    ADD COLUMN resumed_at           TIMESTAMP WITH TIME ZONE;
@@ -0,0 +1,7 @@
+CREATE TABLE outbox
+(
+    id         BIGSERIAL PRIMARY KEY,
+    topic      TEXT                     NOT NULL,
+    payload    JSONB                    NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
@@ -0,0 +1,3 @@
+ALTER TABLE query
+    ADD COLUMN attribute_ranges  JSONB NOT NULL DEFAULT '[]',
+    ADD COLUMN attributes_by_key JSONB NOT NULL DEFAULT '[]';
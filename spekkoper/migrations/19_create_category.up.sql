@@ -0,0 +1,11 @@
+CREATE TABLE category
+(
+    id         INT PRIMARY KEY,
+    key        TEXT                     NOT NULL,
+    name       TEXT                     NOT NULL,
+    full_name  TEXT                     NOT NULL,
+    parent_id  INT,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX category_parent_idx ON category (parent_id, key);
@@ -0,0 +1,2 @@
+ALTER TABLE outbox
+    ADD COLUMN dead_at TIMESTAMP WITH TIME ZONE;
@@ -0,0 +1,13 @@
+DELETE FROM price_history p
+USING (
+    SELECT ctid,
+           price_cents,
+           price_type,
+           lag(price_cents) OVER w AS prev_price_cents,
+           lag(price_type) OVER w  AS prev_price_type
+    FROM price_history
+    WINDOW w AS (PARTITION BY query_id, result_id ORDER BY observed_at)
+) d
+WHERE p.ctid = d.ctid
+  AND d.price_cents = d.prev_price_cents
+  AND d.price_type = d.prev_price_type;
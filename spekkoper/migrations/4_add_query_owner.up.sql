@@ -0,0 +1,4 @@
+ALTER TABLE query
+    ADD COLUMN owner_id TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX query_owner_id_idx ON query (owner_id);
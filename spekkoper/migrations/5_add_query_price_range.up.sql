@@ -0,0 +1,3 @@
+ALTER TABLE query
+    ADD COLUMN price_from_cents INT NOT NULL DEFAULT 0,
+    ADD COLUMN price_to_cents   INT NOT NULL DEFAULT 0;
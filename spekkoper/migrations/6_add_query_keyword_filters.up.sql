@@ -0,0 +1,6 @@
+ALTER TABLE query
+    ADD COLUMN exclude_keywords TEXT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN require_keywords TEXT[] NOT NULL DEFAULT '{}';
+
+ALTER TABLE query_result
+    ADD COLUMN filtered BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,2 @@
+ALTER TABLE query
+    ADD COLUMN include_commercials BOOLEAN NOT NULL DEFAULT false;
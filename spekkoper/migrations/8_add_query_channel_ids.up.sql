@@ -0,0 +1,2 @@
+ALTER TABLE query
+    ADD COLUMN channel_ids TEXT[] NOT NULL DEFAULT '{}';
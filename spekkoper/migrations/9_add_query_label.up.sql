@@ -0,0 +1,2 @@
+ALTER TABLE query
+    ADD COLUMN label TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,142 @@
+package spekkoper
+
+import (
+	"context"
+	"encoding/json"
+
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+// Events are written to the outbox in the same transaction as the results
+// they describe, and published from there. An event is never lost when the
+// service crashes between committing the results and publishing the event,
+// it is published by the next flush instead.
+
+// Periodically publish the events left in the outbox by runs that did not publish them.
+var _ = cron.NewJob("flush-outbox", cron.JobConfig{
+	Title:    "Publish pending events",
+	Every:    1 * cron.Minute,
+	Endpoint: FlushOutbox,
+})
+
+const (
+	outboxNewAds       = "new-advertisements"
+	outboxPriceDropped = "price-dropped"
+
+	// outboxBatchSize bounds the number of events published by a single flush.
+	outboxBatchSize = 100
+)
+
+// outboxTopics publishes the payload of an outbox event to its topic.
+var outboxTopics = map[string]func(ctx context.Context, payload []byte) error{
+	outboxNewAds:       outboxPublisher(NewAds),
+	outboxPriceDropped: outboxPublisher(PriceDropped),
+}
+
+func outboxPublisher[E any](topic *pubsub.Topic[*E]) func(ctx context.Context, payload []byte) error {
+	return func(ctx context.Context, payload []byte) error {
+		var event E
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return err
+		}
+		_, err := topic.Publish(ctx, &event)
+		return err
+	}
+}
+
+// enqueue writes the event to the outbox within the transaction.
+func enqueue(ctx context.Context, tx *sqldb.Tx, topic string, event interface{}) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, "INSERT INTO outbox (topic, payload) VALUES ($1, $2)", topic, string(payload))
+	return err
+}
+
+// FlushOutbox publishes the pending events in the outbox, in the order they were written.
+//
+//encore:api private
+func FlushOutbox(ctx context.Context) error {
+	for {
+		more, err := flushOutbox(ctx)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// flushOutbox publishes a batch of pending events and removes them from the
+// outbox. Events locked by a concurrent flush are skipped. It reports whether
+// more events may be pending, which is not the case when an event could not
+// be published.
+func flushOutbox(ctx context.Context) (bool, error) {
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		// a no-op once the transaction is committed
+		_ = tx.Rollback()
+	}()
+
+	rows, err := tx.Query(ctx, `
+        SELECT id, topic, payload FROM outbox
+        WHERE dead_at IS NULL
+        ORDER BY id
+        LIMIT $1
+        FOR UPDATE SKIP LOCKED
+    `, outboxBatchSize)
+	if err != nil {
+		return false, err
+	}
+	type event struct {
+		id      int64
+		topic   string
+		payload []byte
+	}
+	var events []event
+	for rows.Next() {
+		var e event
+		if err := rows.Scan(&e.id, &e.topic, &e.payload); err != nil {
+			rows.Close()
+			return false, err
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	more := len(events) == outboxBatchSize
+	for _, e := range events {
+		publish, ok := outboxTopics[e.topic]
+		if !ok {
+			// dropping the event would lose it, so it is set aside for a
+			// future version of the service instead of blocking the outbox
+			rlog.Error("unknown outbox topic", "topic", e.topic, "event", e.id)
+			if _, err := tx.Exec(ctx, "UPDATE outbox SET dead_at = now() WHERE id = $1", e.id); err != nil {
+				return false, err
+			}
+			continue
+		}
+		if err := publish(ctx, e.payload); err != nil {
+			// the published events are removed, the others are retried by the next flush
+			rlog.Error("could not publish outbox event", "topic", e.topic, "event", e.id, "err", err)
+			more = false
+			break
+		}
+		if _, err := tx.Exec(ctx, "DELETE FROM outbox WHERE id = $1", e.id); err != nil {
+			return false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, errs.Wrap(err, "could not remove published events from the outbox")
+	}
+	return more, nil
+}
@@ -0,0 +1,135 @@
+package spekkoper
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+// defaultPauseAfterFailures is used for queries without PauseAfterFailures.
+const defaultPauseAfterFailures = 10
+
+// QueryFailingEvent is published when a query is paused because its runs keep failing.
+type QueryFailingEvent struct {
+	QueryID    string
+	OwnerID    string
+	QueryLabel string
+	ChannelIDs []string
+	// BrowserURL opens the search of the query on marktplaats.
+	BrowserURL string
+	// ConsecutiveFailures is the number of failed runs since the last successful run.
+	ConsecutiveFailures int
+	LastError           string
+	PausedAt            time.Time
+}
+
+var QueryFailing = pubsub.NewTopic[*QueryFailingEvent]("query-failing", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// Pause stops the scheduler from running the query until it is resumed.
+//
+//encore:api auth method=POST path=/query/:id/pause
+func Pause(ctx context.Context, id string) (*Query, error) {
+	if _, err := getOwned(ctx, id); err != nil {
+		return nil, err
+	}
+	if _, err := pauseQuery(ctx, id, "paused by the owner"); err != nil {
+		return nil, err
+	}
+	return Get(ctx, id)
+}
+
+// Resume lets the scheduler run a paused query again, it is due immediately.
+// Earlier failures no longer count towards pausing it again.
+//
+//encore:api auth method=POST path=/query/:id/resume
+func Resume(ctx context.Context, id string) (*Query, error) {
+	if _, err := getOwned(ctx, id); err != nil {
+		return nil, err
+	}
+	_, err := sqldb.Exec(ctx, `
+        UPDATE query
+        SET paused_at = NULL, pause_reason = '', resumed_at = now(), next_run_at = NULL
+        WHERE id = $1
+    `, id)
+	if err != nil {
+		return nil, err
+	}
+	return Get(ctx, id)
+}
+
+// pauseQuery pauses the query, it reports false if it was paused already.
+func pauseQuery(ctx context.Context, id, reason string) (bool, error) {
+	res, err := sqldb.Exec(ctx, `
+        UPDATE query SET paused_at = now(), pause_reason = $2
+        WHERE id = $1 AND paused_at IS NULL
+    `, id, reason)
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() == 1, nil
+}
+
+// throttledCodes are the error codes of runs that failed because marktplaats
+// was rate limiting or blocking all queries, see handleRunError. Those runs
+// are not failures of the query.
+var throttledCodes = []string{errs.ResourceExhausted.String(), errs.PermissionDenied.String()}
+
+// consecutiveFailures counts the failed runs of the query since its last
+// successful run, or since it was resumed.
+func consecutiveFailures(ctx context.Context, id string) (int, error) {
+	var n int
+	err := sqldb.QueryRow(ctx, `
+        SELECT count(*) FROM query_run
+        WHERE query_id = $1 AND error_code <> '' AND NOT (error_code = ANY($2)) AND started_at > GREATEST(
+            (SELECT max(started_at) FROM query_run WHERE query_id = $1 AND error_code = ''),
+            (SELECT resumed_at FROM query WHERE id = $1),
+            '-infinity'::timestamptz)
+    `, id, throttledCodes).Scan(&n)
+	return n, err
+}
+
+// pauseIfFailing pauses the query after too many consecutive failed runs, and
+// lets the owner know.
+func pauseIfFailing(ctx context.Context, q Query, runErr error) {
+	limit := q.PauseAfterFailures
+	if limit == 0 {
+		limit = defaultPauseAfterFailures
+	}
+	failures, err := consecutiveFailures(ctx, q.ID)
+	if err != nil {
+		rlog.Error("could not count failed runs", "query", q.ID, "err", err)
+		return
+	}
+	if failures < limit {
+		return
+	}
+	paused, err := pauseQuery(ctx, q.ID, fmt.Sprintf("paused after %d failed runs: %s", failures, runErr))
+	if err != nil {
+		rlog.Error("could not pause failing query", "query", q.ID, "err", err)
+		return
+	}
+	if !paused {
+		return
+	}
+	rlog.Info("paused failing query", "query", q.ID, "failures", failures)
+	event := &QueryFailingEvent{
+		QueryID:             q.ID,
+		OwnerID:             q.OwnerID,
+		QueryLabel:          q.DisplayLabel(),
+		ChannelIDs:          q.ChannelIDs,
+		BrowserURL:          queryBrowserURL(ctx, &q),
+		ConsecutiveFailures: failures,
+		LastError:           runErr.Error(),
+		PausedAt:            time.Now(),
+	}
+	if _, err := QueryFailing.Publish(ctx, event); err != nil {
+		rlog.Error("could not publish failing query", "query", q.ID, "err", err)
+	}
+}
@@ -0,0 +1,148 @@
+package spekkoper
+
+import (
+	"context"
+	"time"
+
+	"encore.app/marktplaats"
+	"encore.dev/beta/errs"
+	"encore.dev/pubsub"
+	"encore.dev/storage/sqldb"
+)
+
+type PriceDroppedEvent struct {
+	QueryID    string
+	OwnerID    string
+	QueryLabel string
+	ChannelIDs []string
+	// BrowserURL opens the search of the query on marktplaats.
+	BrowserURL string
+	// Advertisement is the advertisement with its new price.
+	Advertisement marktplaats.Advertisement
+	OldPriceCents int
+	NewPriceCents int
+	// DropPercentage is the relative drop of the price, 40 for a drop from €250 to €150.
+	DropPercentage float64
+	DroppedAt      time.Time
+}
+
+var PriceDropped = pubsub.NewTopic[*PriceDroppedEvent]("price-dropped", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// updatePrices records the changed prices of the advertisements that were seen
+// before within the transaction, and returns an event for every advertisement
+// that became cheaper.
+func updatePrices(ctx context.Context, tx *sqldb.Tx, q *Query, ads []marktplaats.Advertisement, stored map[string]storedResult) ([]*PriceDroppedEvent, error) {
+	var drops []*PriceDroppedEvent
+	now := time.Now()
+	for _, ad := range ads {
+		prev, ok := stored[ad.ID]
+		if !ok {
+			continue
+		}
+		if err := recordPrice(ctx, tx, q.ID, ad.ID, ad.PriceInfo); err != nil {
+			return nil, err
+		}
+		price := ad.PriceInfo.PriceCents
+		if prev.PriceCents == price {
+			continue
+		}
+		_, err := tx.Exec(ctx, `
+            UPDATE query_result SET price_in_cents = $3
+            WHERE query_id = $1 AND result_id = $2
+        `, q.ID, ad.ID, price)
+		if err != nil {
+			return nil, err
+		}
+
+		// advertisements without a price (bidding, see description) are not a drop
+		if prev.Filtered || prev.PriceCents <= 0 || price <= 0 || price >= prev.PriceCents {
+			continue
+		}
+		drops = append(drops, &PriceDroppedEvent{
+			QueryID:        q.ID,
+			OwnerID:        q.OwnerID,
+			QueryLabel:     q.DisplayLabel(),
+			ChannelIDs:     q.ChannelIDs,
+			Advertisement:  ad,
+			OldPriceCents:  prev.PriceCents,
+			NewPriceCents:  price,
+			DropPercentage: dropPercentage(prev.PriceCents, price),
+			DroppedAt:      now,
+		})
+	}
+	return drops, nil
+}
+
+func dropPercentage(oldPrice, newPrice int) float64 {
+	return float64(oldPrice-newPrice) / float64(oldPrice) * 100
+}
+
+// recordPrice adds the price of the advertisement to its price history, unless
+// it was last observed with the same price. The advertisements are seen on
+// every run, the history only keeps the changes.
+func recordPrice(ctx context.Context, tx *sqldb.Tx, queryID, resultID string, price marktplaats.PriceInfo) error {
+	_, err := tx.Exec(ctx, `
+        INSERT INTO price_history (query_id, result_id, price_cents, price_type)
+        SELECT $1, $2, $3, $4
+        WHERE NOT EXISTS (
+            SELECT 1 FROM (
+                SELECT price_cents, price_type FROM price_history
+                WHERE query_id = $1 AND result_id = $2
+                ORDER BY observed_at DESC
+                LIMIT 1
+            ) last
+            WHERE last.price_cents = $3 AND last.price_type = $4
+        )
+    `, queryID, resultID, price.PriceCents, price.PriceType)
+	return err
+}
+
+type PriceObservation struct {
+	PriceCents int
+	PriceType  string
+	ObservedAt time.Time
+}
+
+type PriceHistoryResult struct {
+	ResultID string
+	// Observations lists the prices the advertisement was seen with, oldest
+	// first. An observation is only added when the price changed.
+	Observations []PriceObservation
+}
+
+// GetPriceHistory retrieves the prices an advertisement found by the query was seen with over time.
+//
+//encore:api auth method=GET path=/query/:id/results/:resultId/history
+func GetPriceHistory(ctx context.Context, id string, resultId string) (*PriceHistoryResult, error) {
+	if _, err := getOwned(ctx, id); err != nil {
+		return nil, err
+	}
+	rows, err := sqldb.Query(ctx, `
+        SELECT price_cents, price_type, observed_at
+        FROM price_history
+        WHERE query_id = $1 AND result_id = $2
+        ORDER BY observed_at
+    `, id, resultId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := &PriceHistoryResult{ResultID: resultId}
+	for rows.Next() {
+		var o PriceObservation
+		if err := rows.Scan(&o.PriceCents, &o.PriceType, &o.ObservedAt); err != nil {
+			return nil, err
+		}
+		res.Observations = append(res.Observations, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(res.Observations) == 0 {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "result not found"}
+	}
+	return res, nil
+}
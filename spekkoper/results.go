@@ -0,0 +1,201 @@
+package spekkoper
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+// Result is an advertisement found by a query.
+type Result struct {
+	ID          string
+	Title       string
+	URL         string
+	City        string
+	PriceCents  int
+	ImageUrls   []string
+	Filtered    bool
+	FirstSeenAt time.Time
+	// PostedAt is the date of the advertisement on marktplaats, if known.
+	PostedAt *time.Time
+}
+
+type ListResultsParams struct {
+	// SortBy is one of first_seen (default), price or date.
+	SortBy string
+	// Order is asc or desc (default).
+	Order string
+	// Cursor continues listing after the last result of a previous page.
+	Cursor string
+	// Limit is the maximum number of results, 25 by default.
+	Limit         int
+	MinPriceCents int
+	MaxPriceCents int
+	City          string
+	// IncludeFiltered includes the results dropped by the keyword rules of the query.
+	IncludeFiltered bool
+}
+
+type ListResultsResponse struct {
+	Results []Result
+	// NextCursor retrieves the next page, it is empty on the last page.
+	NextCursor string
+}
+
+const (
+	defaultResultsLimit = 25
+	maxResultsLimit     = 100
+)
+
+// resultSortColumns maps the supported sort keys to their SQL expressions.
+var resultSortColumns = map[string]string{
+	"first_seen": "first_seen_at",
+	"date":       "COALESCE(posted_at, first_seen_at)",
+	"price":      "COALESCE(price_in_cents, 0)",
+}
+
+func (p ListResultsParams) Validate() error {
+	if _, ok := resultSortColumns[p.sortBy()]; !ok {
+		return &errs.Error{Code: errs.InvalidArgument, Message: "sort by must be one of first_seen, price or date"}
+	}
+	if p.Order != "" && p.Order != "asc" && p.Order != "desc" {
+		return &errs.Error{Code: errs.InvalidArgument, Message: "order must be asc or desc"}
+	}
+	if p.Limit < 0 || p.Limit > maxResultsLimit {
+		return &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("limit must be between 0 and %d", maxResultsLimit)}
+	}
+	return nil
+}
+
+func (p ListResultsParams) sortBy() string {
+	if p.SortBy == "" {
+		return "first_seen"
+	}
+	return p.SortBy
+}
+
+// resultCursor is the position of the last result of a page, encoded in ListResultsResponse.NextCursor.
+type resultCursor struct {
+	Time  time.Time `json:"t,omitempty"`
+	Price int       `json:"p,omitempty"`
+	ID    string    `json:"id"`
+}
+
+func (c resultCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeResultCursor(s string) (*resultCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "invalid cursor"}
+	}
+	c := &resultCursor{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "invalid cursor"}
+	}
+	return c, nil
+}
+
+// ListResults lists the advertisements found by the query.
+//
+//encore:api auth method=GET path=/query/:id/results
+func ListResults(ctx context.Context, id string, p ListResultsParams) (*ListResultsResponse, error) {
+	if _, err := getOwned(ctx, id); err != nil {
+		return nil, err
+	}
+	sortBy := p.sortBy()
+	sortColumn := resultSortColumns[sortBy]
+	limit := p.Limit
+	if limit == 0 {
+		limit = defaultResultsLimit
+	}
+
+	args := []interface{}{id}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	where := []string{"query_id = $1"}
+	if !p.IncludeFiltered {
+		where = append(where, "NOT filtered")
+	}
+	if p.MinPriceCents > 0 {
+		where = append(where, "COALESCE(price_in_cents, 0) >= "+arg(p.MinPriceCents))
+	}
+	if p.MaxPriceCents > 0 {
+		where = append(where, "COALESCE(price_in_cents, 0) <= "+arg(p.MaxPriceCents))
+	}
+	if p.City != "" {
+		where = append(where, "LOWER(city) = LOWER("+arg(p.City)+")")
+	}
+	order, cmp := "DESC", "<"
+	if p.Order == "asc" {
+		order, cmp = "ASC", ">"
+	}
+	if p.Cursor != "" {
+		c, err := decodeResultCursor(p.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		var after interface{} = c.Time
+		if sortBy == "price" {
+			after = c.Price
+		}
+		where = append(where, fmt.Sprintf("(%s, result_id) %s (%s, %s)", sortColumn, cmp, arg(after), arg(c.ID)))
+	}
+
+	// one extra row is selected to find out whether there is a next page
+	rows, err := sqldb.Query(ctx, `
+        SELECT result_id, title, url, COALESCE(city, ''), COALESCE(price_in_cents, 0)::int, image_urls, filtered,
+               first_seen_at, posted_at
+        FROM query_result
+        WHERE `+strings.Join(where, " AND ")+`
+        ORDER BY `+sortColumn+` `+order+`, result_id `+order+`
+        LIMIT `+arg(limit+1), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := &ListResultsResponse{}
+	for rows.Next() {
+		var r Result
+		err := rows.Scan(&r.ID, &r.Title, &r.URL, &r.City, &r.PriceCents, &r.ImageUrls, &r.Filtered, &r.FirstSeenAt, &r.PostedAt)
+		if err != nil {
+			return nil, err
+		}
+		res.Results = append(res.Results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(res.Results) > limit {
+		res.Results = res.Results[:limit]
+		res.NextCursor = cursorFor(sortBy, res.Results[limit-1]).encode()
+	}
+	return res, nil
+}
+
+func cursorFor(sortBy string, r Result) resultCursor {
+	c := resultCursor{ID: r.ID}
+	switch sortBy {
+	case "price":
+		c.Price = r.PriceCents
+	case "date":
+		c.Time = r.FirstSeenAt
+		if r.PostedAt != nil {
+			c.Time = *r.PostedAt
+		}
+	default:
+		c.Time = r.FirstSeenAt
+	}
+	return c
+}
@@ -0,0 +1,180 @@
+package spekkoper
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+// QueryRun is the outcome of a single run of a query.
+type QueryRun struct {
+	StartedAt  time.Time
+	FinishedAt time.Time
+	DurationMs int64
+	// Results is the number of advertisements found, NewResults the number
+	// of them that were not seen before.
+	Results    int
+	NewResults int
+	// ErrorCode and ErrorMessage describe why the run failed, they are empty
+	// when it succeeded.
+	ErrorCode    string
+	ErrorMessage string
+}
+
+type HealthStatus string
+
+const (
+	// HealthOK means none of the recent runs failed.
+	HealthOK HealthStatus = "ok"
+	// HealthDegraded means some of the recent runs failed.
+	HealthDegraded HealthStatus = "degraded"
+	// HealthFailing means the last failingRuns runs failed.
+	HealthFailing HealthStatus = "failing"
+)
+
+const (
+	// healthWindow is the number of recent runs the health of a query is based on.
+	healthWindow = 10
+	// failingRuns is the number of consecutive failed runs after which a query is failing.
+	failingRuns = 3
+	// recordRunTimeout bounds recording a run whose context is done already.
+	recordRunTimeout = 5 * time.Second
+)
+
+// QueryHealth summarizes the recent runs of a query.
+type QueryHealth struct {
+	Status HealthStatus
+	// ConsecutiveFailures is the number of the recent runs that failed since
+	// the last successful run.
+	ConsecutiveFailures int
+	// LastError is the error of the last run, if it failed.
+	LastError string `json:",omitempty"`
+}
+
+// recordRun stores the outcome of a run of the query started at startedAt.
+func recordRun(ctx context.Context, queryID string, startedAt time.Time, res *runResult, runErr error) {
+	if ctx.Err() != nil {
+		// the run is recorded even when it timed out or was canceled
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), recordRunTimeout)
+		defer cancel()
+	}
+	finishedAt := time.Now()
+	var results, newResults int
+	if res != nil {
+		results, newResults = res.results, res.newResults
+	}
+	var code, message string
+	if runErr != nil {
+		code, message = errs.Code(runErr).String(), runErr.Error()
+	}
+	_, err := sqldb.Exec(ctx, `
+        INSERT INTO query_run (query_id, started_at, finished_at, results, new_results, error_code, error_message)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+    `, queryID, startedAt, finishedAt, results, newResults, code, message)
+	if err != nil {
+		rlog.Error("could not record query run", "query", queryID, "err", err)
+	}
+}
+
+// queryHealth determines the health of the query from its recent runs.
+func queryHealth(ctx context.Context, queryID string) (*QueryHealth, error) {
+	rows, err := sqldb.Query(ctx, `
+        SELECT error_code, error_message FROM query_run
+        WHERE query_id = $1
+        ORDER BY started_at DESC
+        LIMIT $2
+    `, queryID, healthWindow)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	h := &QueryHealth{Status: HealthOK}
+	succeeded := false
+	for first := true; rows.Next(); first = false {
+		var code, message string
+		if err := rows.Scan(&code, &message); err != nil {
+			return nil, err
+		}
+		if code == "" {
+			succeeded = true
+			continue
+		}
+		if first {
+			h.LastError = message
+		}
+		if !succeeded {
+			h.ConsecutiveFailures++
+		}
+		h.Status = HealthDegraded
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if h.ConsecutiveFailures >= failingRuns {
+		h.Status = HealthFailing
+	}
+	return h, nil
+}
+
+type ListRunsParams struct {
+	// Limit is the maximum number of runs, 50 by default.
+	Limit int
+}
+
+type ListRunsResponse struct {
+	// Runs are ordered from the most recent run.
+	Runs []QueryRun
+}
+
+const (
+	defaultRunsLimit = 50
+	maxRunsLimit     = 500
+)
+
+func (p ListRunsParams) Validate() error {
+	if p.Limit < 0 || p.Limit > maxRunsLimit {
+		return &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("limit must be between 0 and %d", maxRunsLimit)}
+	}
+	return nil
+}
+
+// ListRuns lists the recent runs of the query.
+//
+//encore:api auth method=GET path=/query/:id/runs
+func ListRuns(ctx context.Context, id string, p ListRunsParams) (*ListRunsResponse, error) {
+	if _, err := getOwned(ctx, id); err != nil {
+		return nil, err
+	}
+	limit := p.Limit
+	if limit == 0 {
+		limit = defaultRunsLimit
+	}
+	rows, err := sqldb.Query(ctx, `
+        SELECT started_at, finished_at, results, new_results, error_code, error_message
+        FROM query_run
+        WHERE query_id = $1
+        ORDER BY started_at DESC
+        LIMIT $2
+    `, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := &ListRunsResponse{}
+	for rows.Next() {
+		var r QueryRun
+		if err := rows.Scan(&r.StartedAt, &r.FinishedAt, &r.Results, &r.NewResults, &r.ErrorCode, &r.ErrorMessage); err != nil {
+			return nil, err
+		}
+		r.DurationMs = r.FinishedAt.Sub(r.StartedAt).Milliseconds()
+		res.Runs = append(res.Runs, r)
+	}
+	return res, rows.Err()
+}
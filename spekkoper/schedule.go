@@ -0,0 +1,105 @@
+package spekkoper
+
+import (
+	"fmt"
+	"time"
+	_ "time/tzdata" // the schedule is in Dutch time, regardless of the timezone of the host
+
+	"encore.dev/beta/errs"
+)
+
+const (
+	// minCheckInterval is the interval of the cron job running the registered queries.
+	minCheckInterval = time.Minute
+	// maxCheckIntervalMinutes keeps queries from being forgotten, they run at least once a week.
+	maxCheckIntervalMinutes = 7 * 24 * 60
+)
+
+// scheduleLocation is the timezone of the active hours and days of a query.
+var scheduleLocation = mustLoadLocation("Europe/Amsterdam")
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+// validateSchedule verifies the check interval, active hours and days and the
+// failures before pausing of the query.
+func validateSchedule(q Query) error {
+	invalid := func(format string, args ...interface{}) error {
+		return &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf(format, args...)}
+	}
+	if q.CheckIntervalMinutes < 0 || q.CheckIntervalMinutes > maxCheckIntervalMinutes {
+		return invalid("check interval must be between 1 and %d minutes", maxCheckIntervalMinutes)
+	}
+	if q.ActiveFromHour < 0 || q.ActiveFromHour > 23 || q.ActiveUntilHour < 0 || q.ActiveUntilHour > 23 {
+		return invalid("active hours must be between 0 and 23")
+	}
+	if q.PauseAfterFailures < 0 {
+		return invalid("pause after failures must not be negative")
+	}
+	for _, d := range q.ActiveDays {
+		if d < int(time.Sunday) || d > int(time.Saturday) {
+			return invalid("active day %d must be between 0 (sunday) and 6 (saturday)", d)
+		}
+	}
+	return nil
+}
+
+// checkInterval returns the time between two runs of the query.
+func (q Query) checkInterval() time.Duration {
+	if d := time.Duration(q.CheckIntervalMinutes) * time.Minute; d > minCheckInterval {
+		return d
+	}
+	return minCheckInterval
+}
+
+// activeAt reports whether the query may run at t.
+func (q Query) activeAt(t time.Time) bool {
+	t = t.In(scheduleLocation)
+	if len(q.ActiveDays) > 0 {
+		active := false
+		for _, d := range q.ActiveDays {
+			active = active || time.Weekday(d) == t.Weekday()
+		}
+		if !active {
+			return false
+		}
+	}
+	from, until, h := q.ActiveFromHour, q.ActiveUntilHour, t.Hour()
+	switch {
+	case from == until:
+		return true
+	case from < until:
+		return h >= from && h < until
+	default: // the active hours wrap around midnight, for example from 7 until 1
+		return h >= from || h < until
+	}
+}
+
+// nextActive returns the first moment from t on at which the query may run.
+func (q Query) nextActive(t time.Time) time.Time {
+	if q.activeAt(t) {
+		return t
+	}
+	// active hours start on the hour, so it is enough to try the next hours of
+	// the coming week
+	h := t.In(scheduleLocation).Truncate(time.Hour)
+	for i := 0; i < 8*24; i++ {
+		h = h.Add(time.Hour)
+		if q.activeAt(h) {
+			return h
+		}
+	}
+	return t
+}
+
+// nextRun returns when the query is due again after a run at t.
+func (q Query) nextRun(t time.Time) time.Time {
+	// runs start somewhere within the minute of the cron job, so the interval
+	// is counted from the start of that minute to not miss the next job
+	return q.nextActive(t.Truncate(time.Minute).Add(q.checkInterval()))
+}
@@ -4,10 +4,15 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"encore.app/marktplaats"
+	"encore.dev/beta/auth"
 	"encore.dev/beta/errs"
-	"encore.dev/cron"
 	"encore.dev/pubsub"
 	"encore.dev/rlog"
 	"encore.dev/storage/sqldb"
@@ -18,11 +23,8 @@ type marktplaatsClient interface {
 	Query(ctx context.Context, request marktplaats.QueryRequest) (*marktplaats.QueryResponse, error)
 }
 
-type mclient struct{}
-
-func (m *mclient) Query(ctx context.Context, request marktplaats.QueryRequest) (*marktplaats.QueryResponse, error) {
-	return marktplaats.Query(ctx, request)
-}
+// client is the marktplaats client shared by the service.
+var client = marktplaats.NewClient()
 
 // encore:service
 type Service struct {
@@ -31,73 +33,99 @@ type Service struct {
 
 func initService() (*Service, error) {
 	return &Service{
-		marktplaats: &mclient{},
+		marktplaats: client,
 	}, nil
 }
 
-type NewQueryResultEvent struct{ Advertisement marktplaats.Advertisement }
+type NewQueryResultEvent struct {
+	QueryID string
+	OwnerID string
+	// QueryLabel describes the saved search that matched, for example "kachel Zibro".
+	QueryLabel string
+	// MatchedAt is the time the advertisement was found by the query.
+	MatchedAt time.Time
+	// ChannelIDs are the notification channels selected for the query,
+	// when empty all channels of the owner are notified.
+	ChannelIDs []string
+	// BrowserURL opens the search of the query on marktplaats.
+	BrowserURL    string
+	Advertisement marktplaats.Advertisement
+}
 
 var NewAds = pubsub.NewTopic[*NewQueryResultEvent]("new-advertisements", pubsub.TopicConfig{
 	DeliveryGuarantee: pubsub.AtLeastOnce,
 })
 
-// Periodically check all registered queries for new advertisements
-var _ = cron.NewJob("run-all-registered-queries", cron.JobConfig{
-	Title:    "Run all registered queries",
-	Every:    1 * cron.Minute,
-	Endpoint: CheckAll,
-})
-
 type User struct {
 	UserName string `json:"username"`
 	Email    string `json:"email"`
 }
 
-//encore:api private
-func CheckAll(ctx context.Context) error {
-	srv :=
-		&Service{
-			marktplaats: &mclient{},
-		}
-	queries, err := getAllRegisteredQueries(ctx)
-	if err != nil {
-		return errs.Wrap(err, "failed to list all registered queries")
-	}
-	for _, u := range queries {
-		if _, err := srv.Run(ctx, u.ID); err != nil {
-			rlog.Error("could not run query", "err", err)
-		}
-	}
-	return nil
-}
-
-func getAllRegisteredQueries(ctx context.Context) ([]Query, error) {
-	rows, err := sqldb.Query(ctx, "SELECT id, query, category, sub_category, postcode, distance_meters FROM query")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	var queries []Query
-
-	for rows.Next() {
-		u := Query{}
-		err = rows.Scan(&u.ID, &u.Query, &u.Category, &u.SubCategory, &u.PostCode, &u.DistanceMeters)
-		if err != nil {
-			return nil, err
-		}
-		queries = append(queries, u)
-	}
-	return queries, nil
-}
-
 type Query struct {
-	ID             string
+	ID      string
+	OwnerID string
+	// Label is a short description of the search shown in notifications,
+	// it defaults to the search terms.
+	Label          string
 	Query          string
 	Category       int
 	SubCategory    int
 	PostCode       string
 	DistanceMeters int
 	AttributesByID []int
+	PriceFromCents int
+	PriceToCents   int
+	// AttributeRanges and AttributesByKey select advertisements by attributes
+	// that are not addressed by id, for example a construction year from 2010.
+	AttributeRanges []marktplaats.AttributeRange
+	AttributesByKey []marktplaats.AttributeValue
+	// ExcludeKeywords drops advertisements that mention any of these keywords
+	// in their title or description, for example "gezocht" or "defect".
+	// A keyword written as /expression/ is matched as a regular expression.
+	ExcludeKeywords []string
+	// RequireKeywords only keeps advertisements that mention all of these keywords.
+	RequireKeywords []string
+	// IncludeCommercials includes advertisements of commercial sellers.
+	IncludeCommercials bool
+	// ChannelIDs selects the notification channels of the owner that are
+	// notified of new advertisements, when empty all channels are notified.
+	ChannelIDs []string
+	// CheckIntervalMinutes is the time between two runs of the query, it
+	// defaults to every minute.
+	CheckIntervalMinutes int
+	// ActiveFromHour and ActiveUntilHour limit the runs of the query to these
+	// hours of the day, Dutch time. The hours may wrap around midnight, for
+	// example from 7 until 1 pauses the query at night. When both are equal the
+	// query runs all day.
+	ActiveFromHour  int
+	ActiveUntilHour int
+	// ActiveDays limits the runs of the query to these days of the week,
+	// 0 is sunday. When empty the query runs every day.
+	ActiveDays []int
+	// LastRunAt and NextRunAt are maintained by the scheduler.
+	LastRunAt *time.Time
+	NextRunAt *time.Time
+	// PauseAfterFailures pauses the query after this many consecutive failed
+	// runs, it defaults to 10.
+	PauseAfterFailures int
+	// PausedAt is set while the query is paused, the scheduler doesn't run it
+	// until it is resumed. PauseReason tells why it was paused.
+	PausedAt    *time.Time
+	PauseReason string
+	// Health summarizes the outcome of the recent runs, it is only set when
+	// retrieving queries.
+	Health *QueryHealth `json:",omitempty"`
+	// BrowserURL opens the search of the query on marktplaats, it is only set
+	// when retrieving queries.
+	BrowserURL string `json:",omitempty"`
+}
+
+// DisplayLabel returns the label of the query, or its search terms when it has no label.
+func (q Query) DisplayLabel() string {
+	if q.Label != "" {
+		return q.Label
+	}
+	return strings.TrimSpace(q.Query)
 }
 
 type PostQueryRequest struct {
@@ -105,61 +133,274 @@ type PostQueryRequest struct {
 	// for example: https://www.marktplaats.nl/l/huis-en-inrichting/kachels/#q:zibro|f:31,32,4205|distanceMeters:50000|postcode:3901EF
 	QueryURL string
 	Query    Query
+	// Attributes filter the advertisements by attributes of the category,
+	// written as key=value with the keys and values listed by
+	// CategoryAttributes, for example condition=gebruikt or offeredSince=vandaag.
+	Attributes []string
 }
 
 func parseQueryFromURL(ctx context.Context, queryURL string) (Query, error) {
-	res, err := marktplaats.ParseURL(ctx, queryURL)
+	categories, err := taxonomy(ctx)
+	if err != nil {
+		return Query{}, err
+	}
+	res, err := marktplaats.ParseURL(queryURL, categories)
 	if err != nil {
 		return Query{}, err
 	}
 	return Query{
-		Query:          res.Query,
-		Category:       res.Category,
-		SubCategory:    res.SubCategory,
-		PostCode:       res.PostCode,
-		DistanceMeters: res.DistanceMeters,
-		AttributesByID: res.AttributesByID,
+		Query:           res.Query,
+		Category:        res.Category,
+		SubCategory:     res.SubCategory,
+		PostCode:        res.PostCode,
+		DistanceMeters:  res.DistanceMeters,
+		AttributesByID:  res.AttributesByID,
+		PriceFromCents:  res.PriceFromCents,
+		PriceToCents:    res.PriceToCents,
+		AttributeRanges: res.AttributeRanges,
+		AttributesByKey: res.AttributesByKey,
 	}, nil
 }
 
-// Post creates a new query
+// withSearch returns the query with the marktplaats search of parsed, the
+// settings that are not part of a marktplaats URL are kept.
+func (q Query) withSearch(parsed Query) Query {
+	q.Query, q.Category, q.SubCategory = parsed.Query, parsed.Category, parsed.SubCategory
+	q.PostCode, q.DistanceMeters = parsed.PostCode, parsed.DistanceMeters
+	q.AttributesByID, q.AttributeRanges, q.AttributesByKey = parsed.AttributesByID, parsed.AttributeRanges, parsed.AttributesByKey
+	q.PriceFromCents, q.PriceToCents = parsed.PriceFromCents, parsed.PriceToCents
+	return q
+}
+
+// Post creates a new query. With a QueryURL the search is parsed from the URL,
+// the other settings are taken from the Query.
 //
 //encore:api auth path=/query method=POST
 func Post(ctx context.Context, r PostQueryRequest) (*Query, error) {
 	q := r.Query
 	if r.QueryURL != "" {
-		var err error
-		q, err = parseQueryFromURL(ctx, r.QueryURL)
+		parsed, err := parseQueryFromURL(ctx, r.QueryURL)
 		if err != nil {
 			rlog.Error("could not parse query from marktplaats URL", "err", err)
 			return nil, err
 		}
+		q = q.withSearch(parsed)
 	}
-	id, err := generateID()
+	uid, err := currentUser()
 	if err != nil {
 		return nil, err
 	}
-	q.ID = id
+	if err := validateChannels(ctx, string(uid), q.ChannelIDs); err != nil {
+		return nil, err
+	}
+	if len(r.Attributes) > 0 {
+		if err := resolveAttributes(ctx, &q, r.Attributes); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := newAdFilter(q); err != nil {
+		return nil, err
+	}
+	if err := q.searchRequest(RunParams{}).Validate(); err != nil {
+		return nil, err
+	}
+	if err := validateSchedule(q); err != nil {
+		return nil, err
+	}
+	q.LastRunAt, q.NextRunAt, q.Health, q.BrowserURL = nil, nil, nil, ""
+	q.PausedAt, q.PauseReason = nil, ""
+	id, err := generateID()
 	if err != nil {
 		return nil, err
-	} else if err := insert(ctx, q.ID, q.Query, q.Category, q.SubCategory, q.PostCode, q.DistanceMeters, q.AttributesByID); err != nil {
+	}
+	q.ID = id
+	q.OwnerID = string(uid)
+	if err := insert(ctx, q); err != nil {
 		return nil, err
 	}
-	return &q, nil
+	// the stored query includes the fields maintained by the service
+	return Get(ctx, q.ID)
 }
 
 // Get retrieves the query configuration for the id.
 //
 //encore:api auth method=GET path=/query/:id
 func Get(ctx context.Context, id string) (*Query, error) {
-	return get(ctx, id)
+	q, err := getOwned(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if q.Health, err = queryHealth(ctx, q.ID); err != nil {
+		return nil, err
+	}
+	categories, err := taxonomy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	q.BrowserURL = browserURL(categories, q)
+	return q, nil
+}
+
+type UpdateQueryRequest struct {
+	// QueryURL replaces the search with the one parsed from a markplaats query URL.
+	QueryURL string
+
+	// The fields below are optional, only the fields that are set are updated.
+	Label              *string
+	Query              *string
+	Category           *int
+	SubCategory        *int
+	PostCode           *string
+	DistanceMeters     *int
+	AttributesByID     *[]int
+	PriceFromCents     *int
+	PriceToCents       *int
+	AttributeRanges    *[]marktplaats.AttributeRange
+	AttributesByKey    *[]marktplaats.AttributeValue
+	ExcludeKeywords    *[]string
+	RequireKeywords    *[]string
+	IncludeCommercials *bool
+	ChannelIDs         *[]string
+
+	CheckIntervalMinutes *int
+	ActiveFromHour       *int
+	ActiveUntilHour      *int
+	ActiveDays           *[]int
+	PauseAfterFailures   *int
+}
+
+// changesSchedule reports whether the request changes when the query runs.
+func (r UpdateQueryRequest) changesSchedule() bool {
+	return r.CheckIntervalMinutes != nil || r.ActiveFromHour != nil || r.ActiveUntilHour != nil || r.ActiveDays != nil
+}
+
+// apply updates q with the fields set on the request.
+func (r UpdateQueryRequest) apply(q *Query) {
+	if r.Label != nil {
+		q.Label = *r.Label
+	}
+	if r.Query != nil {
+		q.Query = *r.Query
+	}
+	if r.Category != nil {
+		q.Category = *r.Category
+	}
+	if r.SubCategory != nil {
+		q.SubCategory = *r.SubCategory
+	}
+	if r.PostCode != nil {
+		q.PostCode = *r.PostCode
+	}
+	if r.DistanceMeters != nil {
+		q.DistanceMeters = *r.DistanceMeters
+	}
+	if r.AttributesByID != nil {
+		q.AttributesByID = *r.AttributesByID
+	}
+	if r.PriceFromCents != nil {
+		q.PriceFromCents = *r.PriceFromCents
+	}
+	if r.PriceToCents != nil {
+		q.PriceToCents = *r.PriceToCents
+	}
+	if r.AttributeRanges != nil {
+		q.AttributeRanges = *r.AttributeRanges
+	}
+	if r.AttributesByKey != nil {
+		q.AttributesByKey = *r.AttributesByKey
+	}
+	if r.ExcludeKeywords != nil {
+		q.ExcludeKeywords = *r.ExcludeKeywords
+	}
+	if r.RequireKeywords != nil {
+		q.RequireKeywords = *r.RequireKeywords
+	}
+	if r.IncludeCommercials != nil {
+		q.IncludeCommercials = *r.IncludeCommercials
+	}
+	if r.ChannelIDs != nil {
+		q.ChannelIDs = *r.ChannelIDs
+	}
+	if r.CheckIntervalMinutes != nil {
+		q.CheckIntervalMinutes = *r.CheckIntervalMinutes
+	}
+	if r.ActiveFromHour != nil {
+		q.ActiveFromHour = *r.ActiveFromHour
+	}
+	if r.ActiveUntilHour != nil {
+		q.ActiveUntilHour = *r.ActiveUntilHour
+	}
+	if r.ActiveDays != nil {
+		q.ActiveDays = *r.ActiveDays
+	}
+	if r.PauseAfterFailures != nil {
+		q.PauseAfterFailures = *r.PauseAfterFailures
+	}
+}
+
+// Update changes the query configuration for the id. Results that were
+// already seen are kept, so existing advertisements are not notified again.
+// A query created before queries had an owner is claimed by the first user
+// that updates it.
+//
+//encore:api auth method=PATCH path=/query/:id
+func Update(ctx context.Context, id string, r UpdateQueryRequest) (*Query, error) {
+	if err := claimUnowned(ctx, id); err != nil {
+		return nil, err
+	}
+	q, err := getOwned(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if r.QueryURL != "" {
+		parsed, err := parseQueryFromURL(ctx, r.QueryURL)
+		if err != nil {
+			rlog.Error("could not parse query from marktplaats URL", "err", err)
+			return nil, err
+		}
+		*q = q.withSearch(parsed)
+	}
+	r.apply(q)
+	if r.ChannelIDs != nil {
+		if err := validateChannels(ctx, q.OwnerID, q.ChannelIDs); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := newAdFilter(*q); err != nil {
+		return nil, err
+	}
+	if err := q.searchRequest(RunParams{}).Validate(); err != nil {
+		return nil, err
+	}
+	if err := validateSchedule(*q); err != nil {
+		return nil, err
+	}
+	if r.changesSchedule() && q.LastRunAt != nil {
+		next := q.nextRun(*q.LastRunAt)
+		q.NextRunAt = &next
+	}
+	if err := update(ctx, *q); err != nil {
+		return nil, err
+	}
+	return Get(ctx, q.ID)
 }
 
 // Delete deletes the query configuration for the id.
 //
 //encore:api auth method=DELETE path=/query/:id
 func Delete(ctx context.Context, id string) error {
-	_, err := sqldb.Exec(ctx, "DELETE FROM query_result WHERE query_id=$1", id)
+	if _, err := getOwned(ctx, id); err != nil {
+		return err
+	}
+	_, err := sqldb.Exec(ctx, "DELETE FROM price_history WHERE query_id=$1", id)
+	if err != nil {
+		return err
+	}
+	_, err = sqldb.Exec(ctx, "DELETE FROM query_run WHERE query_id=$1", id)
+	if err != nil {
+		return err
+	}
+	_, err = sqldb.Exec(ctx, "DELETE FROM query_result WHERE query_id=$1", id)
 	if err != nil {
 		return err
 	}
@@ -174,15 +415,20 @@ type ListResult struct {
 	Queries []Query
 }
 
-// Lists all registered queris
+// Lists all queries registered by the authenticated user
 //
 //encore:api auth method=GET path=/query
 func List(ctx context.Context) (*ListResult, error) {
+	uid, err := currentUser()
+	if err != nil {
+		return nil, err
+	}
 	query := `
-		SELECT id, query, category,sub_category,postcode, 	distance_meters,attributes_by_id
-        FROM query         
+		SELECT ` + queryColumns + `
+        FROM query
+        WHERE owner_id = $1
 	`
-	rows, err := sqldb.Query(ctx, query)
+	rows, err := sqldb.Query(ctx, query, string(uid))
 	if err != nil {
 		return nil, err
 	}
@@ -190,38 +436,196 @@ func List(ctx context.Context) (*ListResult, error) {
 
 	var queries []Query
 	for rows.Next() {
-		var q Query
-		err := rows.Scan(&q.ID, &q.Query, &q.Category, &q.SubCategory, &q.PostCode, &q.DistanceMeters, &q.AttributesByID)
+		q, err := scanQuery(rows)
 		if err != nil {
 			return nil, err
 		}
-		queries = append(queries, q)
+		queries = append(queries, *q)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	categories, err := taxonomy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range queries {
+		if queries[i].Health, err = queryHealth(ctx, queries[i].ID); err != nil {
+			return nil, err
+		}
+		queries[i].BrowserURL = browserURL(categories, &queries[i])
 	}
 	return &ListResult{queries}, nil
 }
 
-func get(ctx context.Context, id string) (*Query, error) {
-	u := &Query{
-		ID: id,
+// queryColumns lists the columns of the query table in the order expected by scanQuery.
+const queryColumns = "id, owner_id, label, query, category, sub_category, postcode, distance_meters, attributes_by_id, price_from_cents, price_to_cents, exclude_keywords, require_keywords, include_commercials, channel_ids, check_interval_minutes, active_from_hour, active_until_hour, active_days, last_run_at, next_run_at, pause_after_failures, paused_at, pause_reason, attribute_ranges, attributes_by_key"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanQuery(row scanner) (*Query, error) {
+	q := &Query{}
+	var attributeRanges, attributesByKey []byte
+	err := row.Scan(&q.ID, &q.OwnerID, &q.Label, &q.Query, &q.Category, &q.SubCategory, &q.PostCode, &q.DistanceMeters, &q.AttributesByID, &q.PriceFromCents, &q.PriceToCents, &q.ExcludeKeywords, &q.RequireKeywords, &q.IncludeCommercials, &q.ChannelIDs, &q.CheckIntervalMinutes, &q.ActiveFromHour, &q.ActiveUntilHour, &q.ActiveDays, &q.LastRunAt, &q.NextRunAt, &q.PauseAfterFailures, &q.PausedAt, &q.PauseReason, &attributeRanges, &attributesByKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := unmarshalJSONArray(attributeRanges, &q.AttributeRanges); err != nil {
+		return nil, err
+	}
+	if err := unmarshalJSONArray(attributesByKey, &q.AttributesByKey); err != nil {
+		return nil, err
 	}
-	err := sqldb.QueryRow(ctx, `
-        SELECT query, category, sub_category, postcode, distance_meters, attributes_by_id FROM query
+	return q, nil
+}
+
+// unmarshalJSONArray decodes a json array column, an empty array is left nil
+// like the other array columns.
+func unmarshalJSONArray[T any](b []byte, s *[]T) error {
+	if string(b) == "[]" {
+		return nil
+	}
+	return json.Unmarshal(b, s)
+}
+
+func get(ctx context.Context, id string) (*Query, error) {
+	return scanQuery(sqldb.QueryRow(ctx, `
+        SELECT `+queryColumns+` FROM query
         WHERE id = $1
-    `, id).Scan(&u.Query, &u.Category, &u.SubCategory, &u.PostCode, &u.DistanceMeters, &u.AttributesByID)
+    `, id))
+}
+
+// getOwned retrieves the query for the id and verifies it belongs to the authenticated user.
+func getOwned(ctx context.Context, id string) (*Query, error) {
+	uid, err := currentUser()
+	if err != nil {
+		return nil, err
+	}
+	q, err := get(ctx, id)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "query not found"}
+	} else if err != nil {
+		return nil, err
+	}
+	if q.OwnerID != string(uid) {
+		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "query belongs to another user"}
+	}
+	return q, nil
+}
 
-	return u, err
+// claimUnowned gives the query to the authenticated user if it has no owner,
+// the queries that existed before owners were introduced have an empty owner.
+func claimUnowned(ctx context.Context, id string) error {
+	uid, err := currentUser()
+	if err != nil {
+		return err
+	}
+	res, err := sqldb.Exec(ctx, "UPDATE query SET owner_id = $2 WHERE id = $1 AND owner_id = ''", id, string(uid))
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() > 0 {
+		rlog.Info("claimed query without owner", "query", id, "owner", uid)
+	}
+	return nil
+}
+
+// notificationsDB is the database of the notifications service, the channels
+// selected by a query must be channels of its owner.
+var notificationsDB = sqldb.Named("notifications")
+
+// validateChannels verifies the channels belong to the owner. Notifications
+// for channels that don't are never delivered.
+func validateChannels(ctx context.Context, ownerID string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	rows, err := notificationsDB.Query(ctx, `
+        SELECT id FROM notification_channel
+        WHERE owner_id = $1 AND id = ANY($2)
+    `, ownerID, ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var owned []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		owned = append(owned, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if !lo.Contains(owned, id) {
+			return &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("unknown notification channel %q", id)}
+		}
+	}
+	return nil
+}
+
+// currentUser returns the uid of the authenticated user making the request.
+func currentUser() (auth.UID, error) {
+	uid, ok := auth.UserID()
+	if !ok {
+		return "", &errs.Error{Code: errs.Unauthenticated, Message: "no authenticated user"}
+	}
+	return uid, nil
 }
 
 // insert a query into the database.
-func insert(ctx context.Context, id, query string, category, subCategory int, postcode string, distance int, attrs []int) error {
+func insert(ctx context.Context, q Query) error {
+	_, err := sqldb.Exec(ctx, `
+        INSERT INTO query (id, owner_id, query, category, sub_category, postcode, distance_meters, attributes_by_id,
+                           price_from_cents, price_to_cents, exclude_keywords, require_keywords, include_commercials,
+                           channel_ids, label, check_interval_minutes, active_from_hour, active_until_hour, active_days,
+                           pause_after_failures, attribute_ranges, attributes_by_key)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22)
+    `, q.ID, q.OwnerID, q.Query, q.Category, q.SubCategory, q.PostCode, q.DistanceMeters, q.AttributesByID,
+		q.PriceFromCents, q.PriceToCents, nonNil(q.ExcludeKeywords), nonNil(q.RequireKeywords), q.IncludeCommercials,
+		nonNil(q.ChannelIDs), q.Label, q.CheckIntervalMinutes, q.ActiveFromHour, q.ActiveUntilHour, nonNil(q.ActiveDays),
+		q.PauseAfterFailures, jsonArray(q.AttributeRanges), jsonArray(q.AttributesByKey))
+
+	return err
+}
+
+// update writes the configuration of an existing query to the database.
+func update(ctx context.Context, q Query) error {
 	_, err := sqldb.Exec(ctx, `
-        INSERT INTO query (id, query, category, sub_category, postcode, distance_meters, attributes_by_id )
-        VALUES ($1, $2, $3, $4, $5, $6, $7)
-    `, id, query, category, subCategory, postcode, distance, attrs)
+        UPDATE query
+        SET query = $2, category = $3, sub_category = $4, postcode = $5, distance_meters = $6, attributes_by_id = $7,
+            price_from_cents = $8, price_to_cents = $9, exclude_keywords = $10, require_keywords = $11,
+            include_commercials = $12, channel_ids = $13, label = $14, check_interval_minutes = $15,
+            active_from_hour = $16, active_until_hour = $17, active_days = $18, next_run_at = $19,
+            pause_after_failures = $20, attribute_ranges = $21, attributes_by_key = $22
+        WHERE id = $1
+    `, q.ID, q.Query, q.Category, q.SubCategory, q.PostCode, q.DistanceMeters, q.AttributesByID,
+		q.PriceFromCents, q.PriceToCents, nonNil(q.ExcludeKeywords), nonNil(q.RequireKeywords), q.IncludeCommercials,
+		nonNil(q.ChannelIDs), q.Label, q.CheckIntervalMinutes, q.ActiveFromHour, q.ActiveUntilHour, nonNil(q.ActiveDays),
+		q.NextRunAt, q.PauseAfterFailures, jsonArray(q.AttributeRanges), jsonArray(q.AttributesByKey))
 
 	return err
 }
 
+// nonNil returns an empty slice for nil, for storing in NOT NULL array columns.
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
+
+// jsonArray encodes the slice for storing in a NOT NULL json column.
+func jsonArray[T any](s []T) string {
+	b, _ := json.Marshal(nonNil(s))
+	return string(b)
+}
+
 // generateID generates a random short ID.
 func generateID() (string, error) {
 	var data [6]byte // 6 bytes of entropy
@@ -236,85 +640,244 @@ type QueryResponse struct {
 }
 
 type RunParams struct {
-	Limit              int
-	Offset             int
+	Limit  int
+	Offset int
+	// IncludeCommercials includes advertisements of commercial sellers,
+	// even if the query itself does not.
 	IncludeCommercials bool
+	// DeepScan keeps fetching the next page of results until it reaches an
+	// advertisement that was seen before, or the end of the results.
+	DeepScan bool
 }
 
-// Run executes a stored query
+// maxDeepScanPages bounds the number of pages fetched in a single deep scan.
+const maxDeepScanPages = 10
+
+// Run executes a stored query of the authenticated user.
 //
-//encore:api public path=/query/:id/run
-func (srv *Service) Run(ctx context.Context, id string) (*QueryResponse, error) {
+//encore:api auth path=/query/:id/run
+func (srv *Service) Run(ctx context.Context, id string, p RunParams) (*QueryResponse, error) {
+	if _, err := getOwned(ctx, id); err != nil {
+		return nil, err
+	}
+	res, err := srv.runAndRecord(ctx, id, p)
+	if err != nil {
+		return nil, err
+	}
+	return &QueryResponse{
+		Advertisements: res.matched,
+	}, nil
+}
+
+// runAndRecord executes the query and records the run in its history. It
+// doesn't check the owner of the query, the scheduler runs the queries of
+// all users.
+func (srv *Service) runAndRecord(ctx context.Context, id string, p RunParams) (*runResult, error) {
+	startedAt := time.Now()
+	res, err := srv.run(ctx, id, p)
+	if !errors.Is(err, sqldb.ErrNoRows) {
+		recordRun(ctx, id, startedAt, res, err)
+	}
+	return res, err
+}
+
+// runResult summarizes a run of a query.
+type runResult struct {
+	// results is the number of advertisements found, newResults the number
+	// of them that were not seen before.
+	results    int
+	newResults int
+	// matched are the new advertisements that passed the filters of the query.
+	matched []marktplaats.Advertisement
+}
+
+func (srv *Service) run(ctx context.Context, id string, p RunParams) (*runResult, error) {
 	q, err := get(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := srv.marktplaats.Query(ctx, marktplaats.QueryRequest{
-		Query:              q.Query,
-		PostCode:           q.PostCode,
-		DistanceMeters:     q.DistanceMeters,
-		Limit:              0,
-		Offset:             0,
-		IncludeCommercials: false,
-		Category:           q.Category,
-		SubCategory:        q.SubCategory,
-	})
+	stored, err := getStoredResults(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
-	stored, err := getResultIDsFromDB(ctx, id)
+	ads, err := srv.search(ctx, q, p, stored)
 	if err != nil {
 		return nil, err
 	}
 
-	newAds := lo.Filter(res.Advertisements, func(advertisement marktplaats.Advertisement, _ int) bool {
-		return !lo.Contains(stored, advertisement.ID)
+	newAds := lo.Filter(ads, func(advertisement marktplaats.Advertisement, _ int) bool {
+		_, seen := stored[advertisement.ID]
+		return !seen
 	})
 
+	filter, err := newAdFilter(*q)
+	if err != nil {
+		return nil, err
+	}
+
+	// the URL is built before the transaction is opened, so it is not held
+	// open while the categories are read
+	var queryURL string
+	if len(ads) > 0 {
+		queryURL = queryBrowserURL(ctx, q)
+	}
+
 	tx, err := sqldb.Begin(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		// a no-op once the transaction is committed
+		_ = tx.Rollback()
+	}()
 
-	// get results of the current stuff
-	lo.ForEach(newAds, func(advertisement marktplaats.Advertisement, _ int) {
-		err = storeResult(ctx, id, advertisement)
-	})
+	drops, err := updatePrices(ctx, tx, q, ads, stored)
 	if err != nil {
-		if err := tx.Rollback(); err != nil {
-			//rlog.Error(err)
-		}
 		return nil, err
 	}
+
+	for _, event := range drops {
+		event.BrowserURL = queryURL
+	}
+
+	// filtered advertisements are stored as well, so they are not evaluated
+	// again on the next run. An advertisement stored by a concurrent run of the
+	// query is skipped, that run notifies it.
+	matchedAt := time.Now()
+	var matched []marktplaats.Advertisement
+	for _, ad := range newAds {
+		ok := filter.Match(ad)
+		inserted, err := storeResult(ctx, tx, id, ad, !ok)
+		if err != nil {
+			return nil, errs.Wrap(err, "could not write query results to db")
+		}
+		if !inserted || !ok {
+			continue
+		}
+		matched = append(matched, ad)
+		event := &NewQueryResultEvent{
+			QueryID:       q.ID,
+			OwnerID:       q.OwnerID,
+			QueryLabel:    q.DisplayLabel(),
+			MatchedAt:     matchedAt,
+			ChannelIDs:    q.ChannelIDs,
+			BrowserURL:    queryURL,
+			Advertisement: ad,
+		}
+		if err := enqueue(ctx, tx, outboxNewAds, event); err != nil {
+			return nil, err
+		}
+	}
+	for _, event := range drops {
+		if err := enqueue(ctx, tx, outboxPriceDropped, event); err != nil {
+			return nil, err
+		}
+	}
 	if err := tx.Commit(); err != nil {
 		return nil, errs.Wrap(err, "could not write query results to db")
 	}
 
-	lo.ForEach(newAds, func(ad marktplaats.Advertisement, _ int) {
-		if _, err := NewAds.Publish(ctx, &NewQueryResultEvent{Advertisement: ad}); err != nil {
-			rlog.Error("could not publish new ad", "err", err)
+	// the events are published by the next flush of the outbox if this one fails
+	if err := FlushOutbox(ctx); err != nil {
+		rlog.Error("could not publish events", "query", q.ID, "err", err)
+	}
+	return &runResult{
+		results:    len(ads),
+		newResults: len(newAds),
+		matched:    matched,
+	}, nil
+}
+
+// searchRequest returns the marktplaats search for the query.
+func (q Query) searchRequest(p RunParams) marktplaats.QueryRequest {
+	return marktplaats.QueryRequest{
+		Query:              q.Query,
+		PostCode:           q.PostCode,
+		DistanceMeters:     q.DistanceMeters,
+		AttributesByID:     q.AttributesByID,
+		AttributeRanges:    q.AttributeRanges,
+		AttributesByKey:    q.AttributesByKey,
+		Limit:              p.Limit,
+		Offset:             p.Offset,
+		IncludeCommercials: q.IncludeCommercials || p.IncludeCommercials,
+		Category:           q.Category,
+		SubCategory:        q.SubCategory,
+		PriceFromCents:     q.PriceFromCents,
+		PriceToCents:       q.PriceToCents,
+	}
+}
+
+// search queries marktplaats for the stored query. In deep scan mode it walks
+// the result pages until a page contains one of the seen advertisements. A
+// query without seen advertisements only fetches the first page, walking all
+// pages would notify hundreds of old advertisements on its first run.
+func (srv *Service) search(ctx context.Context, q *Query, p RunParams, seen map[string]storedResult) ([]marktplaats.Advertisement, error) {
+	req := q.searchRequest(p)
+	pageSize := marktplaats.DefaultLimit
+	if p.Limit > 0 {
+		pageSize = p.Limit
+	}
+
+	var ads []marktplaats.Advertisement
+	for page := 1; ; page++ {
+		res, err := srv.marktplaats.Query(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		ads = append(ads, res.Advertisements...)
+
+		if !p.DeepScan || len(seen) == 0 || page >= maxDeepScanPages {
+			break
+		}
+		if lo.SomeBy(res.Advertisements, func(ad marktplaats.Advertisement) bool {
+			_, ok := seen[ad.ID]
+			return ok
+		}) {
+			break
+		}
+		req.Offset += pageSize
+		if req.Offset >= res.TotalResultCount {
+			break
 		}
-	})
-	foo := &QueryResponse{
-		Advertisements: newAds,
 	}
-	return foo, nil
+	// listings can shift between pages while walking them
+	return lo.UniqBy(ads, func(ad marktplaats.Advertisement) string {
+		return ad.ID
+	}), nil
 }
 
-func storeResult(ctx context.Context, queryID string, ad marktplaats.Advertisement) error {
-	_, err := sqldb.Exec(ctx, `
-        INSERT INTO query_result (query_id, result_id, title, city, url, price_in_cents, image_urls)
-        VALUES ($1, $2, $3, $4, $5, $6, $7)
-    `, queryID, ad.ID, ad.Title, ad.Location.CityName, ad.URL, ad.PriceInfo.PriceCents, ad.ImageUrls)
+// storeResult stores a new advertisement found by the query within the
+// transaction. It reports false when the advertisement was stored already.
+func storeResult(ctx context.Context, tx *sqldb.Tx, queryID string, ad marktplaats.Advertisement, filtered bool) (bool, error) {
+	var postedAt *time.Time
+	if !ad.Date.IsZero() {
+		postedAt = &ad.Date
+	}
+	res, err := tx.Exec(ctx, `
+        INSERT INTO query_result (query_id, result_id, title, city, url, price_in_cents, image_urls, filtered, posted_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+        ON CONFLICT (query_id, result_id) DO NOTHING
+    `, queryID, ad.ID, ad.Title, ad.Location.CityName, ad.URL, ad.PriceInfo.PriceCents, ad.ImageUrls, filtered, postedAt)
+	if err != nil {
+		return false, err
+	}
+	if res.RowsAffected() == 0 {
+		return false, nil
+	}
+	return true, recordPrice(ctx, tx, queryID, ad.ID, ad.PriceInfo)
+}
 
-	return err
+// storedResult is the state of an advertisement that was seen before by a query.
+type storedResult struct {
+	PriceCents int
+	Filtered   bool
 }
 
-func getResultIDsFromDB(ctx context.Context, queryID string) ([]string, error) {
+func getStoredResults(ctx context.Context, queryID string) (map[string]storedResult, error) {
 	query := `
-		SELECT result_id
+		SELECT result_id, COALESCE(price_in_cents, 0)::int, filtered
         FROM query_result 
         WHERE query_id = $1
 	`
@@ -324,15 +887,16 @@ func getResultIDsFromDB(ctx context.Context, queryID string) ([]string, error) {
 	}
 	defer rows.Close()
 
-	var ids []string
+	results := map[string]storedResult{}
 	for rows.Next() {
 		var id string
+		var r storedResult
 
-		err := rows.Scan(&id)
+		err := rows.Scan(&id, &r.PriceCents, &r.Filtered)
 		if err != nil {
 			return nil, err
 		}
-		ids = append(ids, id)
+		results[id] = r
 	}
-	return ids, nil
+	return results, rows.Err()
 }
@@ -2,13 +2,34 @@ package spekkoper
 
 import (
 	"context"
+	"os"
 	"testing"
+	"time"
 
 	"encore.app/marktplaats"
+	"encore.app/marktplaats/marktplaatstest"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/et"
+	"encore.dev/storage/sqldb"
+	"github.com/samber/lo"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
 
+// fakeServer serves the marktplaats requests of all tests, they never reach
+// marktplaats. It records the requests of every test, so tests only inspect
+// the requests made after they started.
+var fakeServer *marktplaatstest.Server
+
+func TestMain(m *testing.M) {
+	fakeServer = marktplaatstest.NewServer()
+	client = marktplaats.NewClient(marktplaats.WithBaseURL(fakeServer.URL))
+	code := m.Run()
+	fakeServer.Close()
+	os.Exit(code)
+}
+
 func TestRegisterNewQuery(t *testing.T) {
 	q := Query{
 		Query:          "bikes",
@@ -18,10 +39,11 @@ func TestRegisterNewQuery(t *testing.T) {
 		DistanceMeters: 99,
 		AttributesByID: []int{1, 2, 3},
 	}
-	ctx := context.TODO()
+	ctx := auth.WithContext(context.TODO(), "alice", nil)
 	res, err := Post(ctx, PostQueryRequest{Query: q})
 	assert.NoError(t, err)
 	assert.NotEmpty(t, res.ID)
+	assert.Equal(t, "alice", res.OwnerID)
 	t.Run("get the query by its id", func(t *testing.T) {
 		res2, err := Get(ctx, res.ID)
 		assert.NoError(t, err)
@@ -34,7 +56,89 @@ func TestRegisterNewQuery(t *testing.T) {
 	})
 	t.Run("get a non existent query", func(t *testing.T) {
 		_, err := Get(ctx, "foo")
-		assert.Error(t, err)
+		assert.Equal(t, errs.NotFound, errs.Code(err))
+	})
+	t.Run("other users cannot see the query", func(t *testing.T) {
+		bob := auth.WithContext(context.TODO(), "bob", nil)
+		_, err := Get(bob, res.ID)
+		assert.Equal(t, errs.PermissionDenied, errs.Code(err))
+
+		qs, err := List(bob)
+		assert.NoError(t, err)
+		assert.Empty(t, qs.Queries)
+
+		err = Delete(bob, res.ID)
+		assert.Equal(t, errs.PermissionDenied, errs.Code(err))
+
+		_, err = Update(bob, res.ID, UpdateQueryRequest{})
+		assert.Equal(t, errs.PermissionDenied, errs.Code(err))
+	})
+	t.Run("update the query", func(t *testing.T) {
+		postcode := "1234AB"
+		res2, err := Update(ctx, res.ID, UpdateQueryRequest{PostCode: &postcode})
+		assert.NoError(t, err)
+		assert.Equal(t, postcode, res2.PostCode)
+		assert.Equal(t, res.Query, res2.Query)
+		assert.Equal(t, res.AttributesByID, res2.AttributesByID)
+
+		res3, err := Get(ctx, res.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, res2, res3)
+	})
+	t.Run("post a query URL with settings", func(t *testing.T) {
+		posted, err := Post(ctx, PostQueryRequest{
+			QueryURL: "https://www.marktplaats.nl/q/zibro/#PriceCentsTo:15000",
+			Query: Query{
+				Query: "ignored", Label: "kachel", ExcludeKeywords: []string{"defect"}, RequireKeywords: []string{"zibro"},
+				IncludeCommercials: true, CheckIntervalMinutes: 15, PauseAfterFailures: 3,
+			},
+		})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "zibro", posted.Query)
+			assert.Equal(t, 15000, posted.PriceToCents)
+			assert.Equal(t, "kachel", posted.Label)
+			assert.Equal(t, []string{"defect"}, posted.ExcludeKeywords)
+			assert.Equal(t, []string{"zibro"}, posted.RequireKeywords)
+			assert.True(t, posted.IncludeCommercials)
+			assert.Equal(t, 15, posted.CheckIntervalMinutes)
+			assert.Equal(t, 3, posted.PauseAfterFailures)
+			assert.NoError(t, Delete(ctx, posted.ID))
+		}
+	})
+	t.Run("select notification channels", func(t *testing.T) {
+		_, err := notificationsDB.Exec(ctx, `
+            INSERT INTO notification_channel (id, owner_id, type, name, topic) VALUES ('alice-ntfy', 'alice', 'ntfy', 'telefoon', 'kachels')
+        `)
+		assert.NoError(t, err)
+
+		channels := []string{"alice-ntfy"}
+		updated, err := Update(ctx, res.ID, UpdateQueryRequest{ChannelIDs: &channels})
+		if assert.NoError(t, err) {
+			assert.Equal(t, channels, updated.ChannelIDs)
+		}
+		for _, ids := range [][]string{{"deleted"}, {"alice-ntfy", "bobs-channel"}} {
+			_, err = Update(ctx, res.ID, UpdateQueryRequest{ChannelIDs: &ids})
+			assert.Equal(t, errs.InvalidArgument, errs.Code(err), ids)
+			_, err = Post(ctx, PostQueryRequest{Query: Query{Query: "kachel", ChannelIDs: ids}})
+			assert.Equal(t, errs.InvalidArgument, errs.Code(err), ids)
+		}
+	})
+	t.Run("claim a query without owner", func(t *testing.T) {
+		legacy, err := Post(ctx, PostQueryRequest{Query: Query{Query: "kachel"}})
+		assert.NoError(t, err)
+		_, err = sqldb.Exec(ctx, "UPDATE query SET owner_id = '' WHERE id = $1", legacy.ID)
+		assert.NoError(t, err)
+
+		bob := auth.WithContext(context.TODO(), "bob", nil)
+		label := "kachel"
+		claimed, err := Update(bob, legacy.ID, UpdateQueryRequest{Label: &label})
+		assert.NoError(t, err)
+		assert.Equal(t, "bob", claimed.OwnerID)
+
+		// once claimed the query belongs to bob
+		_, err = Update(ctx, legacy.ID, UpdateQueryRequest{Label: &label})
+		assert.Equal(t, errs.PermissionDenied, errs.Code(err))
+		assert.NoError(t, Delete(bob, legacy.ID))
 	})
 	t.Run("delete the query", func(t *testing.T) {
 		err := Delete(ctx, res.ID)
@@ -58,13 +162,16 @@ func (m *mpMock) Query(ctx context.Context, request marktplaats.QueryRequest) (*
 
 func TestRun(t *testing.T) {
 	query := Query{
-		Query:          "bikes",
-		Category:       10,
-		SubCategory:    20,
-		PostCode:       "0000XX",
-		DistanceMeters: 99,
+		Query:           "bikes",
+		Category:        10,
+		SubCategory:     20,
+		PostCode:        "0000XX",
+		DistanceMeters:  99,
+		AttributesByID:  []int{31, 32},
+		AttributeRanges: []marktplaats.AttributeRange{{Key: "constructionYear", From: 2010}},
+		AttributesByKey: []marktplaats.AttributeValue{{Key: "offeredSince", Value: "Gisteren"}},
 	}
-	ctx := context.TODO()
+	ctx := auth.WithContext(context.TODO(), "alice", nil)
 	var err error
 	q, err := Post(ctx, PostQueryRequest{Query: query})
 	if err != nil {
@@ -79,6 +186,9 @@ func TestRun(t *testing.T) {
 		Query:              q.Query,
 		PostCode:           q.PostCode,
 		DistanceMeters:     q.DistanceMeters,
+		AttributesByID:     query.AttributesByID,
+		AttributeRanges:    query.AttributeRanges,
+		AttributesByKey:    query.AttributesByKey,
 		Limit:              0,
 		Offset:             0,
 		IncludeCommercials: false,
@@ -111,7 +221,15 @@ func TestRun(t *testing.T) {
 		marktplaats: m,
 	}
 
-	res, err := s.Run(ctx, id)
+	t.Run("other users cannot run the query", func(t *testing.T) {
+		_, err := s.Run(auth.WithContext(context.TODO(), "bob", nil), id, RunParams{})
+		assert.Equal(t, errs.PermissionDenied, errs.Code(err))
+		_, err = s.Run(context.TODO(), id, RunParams{})
+		assert.Error(t, err)
+		m.AssertNotCalled(t, "Query", mock.Anything, mock.Anything)
+	})
+
+	res, err := s.Run(ctx, id, RunParams{})
 	assert.NoError(t, err)
 	assert.NotNil(t, res)
 	assert.Len(t, res.Advertisements, 1)
@@ -121,6 +239,9 @@ func TestRun(t *testing.T) {
 			Query:              q.Query,
 			PostCode:           q.PostCode,
 			DistanceMeters:     q.DistanceMeters,
+			AttributesByID:     query.AttributesByID,
+			AttributeRanges:    query.AttributeRanges,
+			AttributesByKey:    query.AttributesByKey,
 			Limit:              0,
 			Offset:             0,
 			IncludeCommercials: false,
@@ -142,11 +263,577 @@ func TestRun(t *testing.T) {
 				},
 			},
 		}, nil).Once()
-		res, err := s.Run(ctx, id)
+		res, err := s.Run(ctx, id, RunParams{})
 		assert.NoError(t, err)
 		assert.NotNil(t, res)
 		assert.Len(t, res.Advertisements, 1)
 		assert.Equal(t, "bar", res.Advertisements[0].ID)
 		assert.Equal(t, imageUrls, res.Advertisements[0].ImageUrls)
 	})
+	t.Run("list the results", func(t *testing.T) {
+		res, err := ListResults(ctx, id, ListResultsParams{SortBy: "price", Order: "asc", Limit: 1})
+		assert.NoError(t, err)
+		if assert.Len(t, res.Results, 1) {
+			assert.Equal(t, "foo", res.Results[0].ID)
+			assert.Equal(t, 10, res.Results[0].PriceCents)
+		}
+		assert.NotEmpty(t, res.NextCursor)
+
+		res, err = ListResults(ctx, id, ListResultsParams{SortBy: "price", Order: "asc", Limit: 1, Cursor: res.NextCursor})
+		assert.NoError(t, err)
+		if assert.Len(t, res.Results, 1) {
+			assert.Equal(t, "bar", res.Results[0].ID)
+			assert.Equal(t, imageUrls, res.Results[0].ImageUrls)
+		}
+		assert.Empty(t, res.NextCursor)
+
+		res, err = ListResults(ctx, id, ListResultsParams{City: "rotterdam"})
+		assert.NoError(t, err)
+		assert.Len(t, res.Results, 1)
+	})
+	t.Run("list the runs", func(t *testing.T) {
+		res, err := ListRuns(ctx, id, ListRunsParams{})
+		assert.NoError(t, err)
+		if assert.Len(t, res.Runs, 2) {
+			assert.Equal(t, 1, res.Runs[0].NewResults)
+			assert.Empty(t, res.Runs[0].ErrorCode)
+		}
+		q, err := Get(ctx, id)
+		assert.NoError(t, err)
+		assert.Equal(t, HealthOK, q.Health.Status)
+	})
+}
+
+func TestQueryHealth(t *testing.T) {
+	ctx := auth.WithContext(context.TODO(), "alice", nil)
+	q, err := Post(ctx, PostQueryRequest{Query: Query{Query: "kapot"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mpMock{}
+	m.On("Query", mock.Anything, mock.Anything).Return(nil, &errs.Error{Code: errs.Unavailable, Message: "marktplaats is down"})
+	s := &Service{marktplaats: m}
+
+	for i := 1; i <= failingRuns; i++ {
+		_, err := s.Run(ctx, q.ID, RunParams{})
+		assert.Error(t, err)
+		q, err := Get(ctx, q.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, i, q.Health.ConsecutiveFailures)
+		assert.Contains(t, q.Health.LastError, "marktplaats is down")
+		if i < failingRuns {
+			assert.Equal(t, HealthDegraded, q.Health.Status)
+		} else {
+			assert.Equal(t, HealthFailing, q.Health.Status)
+		}
+	}
+	runs, err := ListRuns(ctx, q.ID, ListRunsParams{Limit: 1})
+	assert.NoError(t, err)
+	if assert.Len(t, runs.Runs, 1) {
+		assert.Equal(t, "unavailable", runs.Runs[0].ErrorCode)
+	}
+}
+
+func TestAdFilter(t *testing.T) {
+	f, err := newAdFilter(Query{
+		ExcludeKeywords: []string{"gezocht", "/onderde(el|len)/"},
+		RequireKeywords: []string{"Zibro"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, f.Match(marktplaats.Advertisement{Title: "Zibro kachel", Description: "werkt prima"}))
+	assert.False(t, f.Match(marktplaats.Advertisement{Title: "Gezocht: zibro kachel"}))
+	assert.False(t, f.Match(marktplaats.Advertisement{Title: "Zibro kachel", Description: "voor onderdelen"}))
+	assert.False(t, f.Match(marktplaats.Advertisement{Title: "Qlima kachel"}))
+
+	t.Run("invalid regular expression", func(t *testing.T) {
+		_, err := newAdFilter(Query{ExcludeKeywords: []string{"/(/"}})
+		assert.Error(t, err)
+	})
+}
+
+func TestRunDeepScan(t *testing.T) {
+	ctx := auth.WithContext(context.TODO(), "alice", nil)
+	q, err := Post(ctx, PostQueryRequest{Query: Query{Query: "fiets", IncludeCommercials: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := marktplaats.QueryRequest{Query: q.Query, IncludeCommercials: true}
+	page := func(ids ...string) *marktplaats.QueryResponse {
+		res := &marktplaats.QueryResponse{TotalResultCount: 100}
+		for _, id := range ids {
+			res.Advertisements = append(res.Advertisements, marktplaats.Advertisement{ID: id, Title: id})
+		}
+		return res
+	}
+
+	m := &mpMock{}
+	s := &Service{marktplaats: m}
+	first, second := req, req
+	first.Limit, second.Limit = 2, 2
+	second.Offset = 2
+
+	// the first run of a new query has nothing to stop at, so it only
+	// fetches the first page instead of notifying every page
+	m.On("Query", mock.Anything, first).Return(page("a", "b"), nil).Once()
+	res, err := s.Run(ctx, q.ID, RunParams{Limit: 2, DeepScan: true})
+	assert.NoError(t, err)
+	assert.Len(t, res.Advertisements, 2)
+	m.AssertExpectations(t)
+
+	// the first page only has new ads, the second page reaches the ads seen before
+	m.On("Query", mock.Anything, first).Return(page("d", "c"), nil).Once()
+	m.On("Query", mock.Anything, second).Return(page("a", "b"), nil).Once()
+	res, err = s.Run(ctx, q.ID, RunParams{Limit: 2, DeepScan: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"d", "c"}, lo.Map(res.Advertisements, func(ad marktplaats.Advertisement, _ int) string {
+		return ad.ID
+	}))
+	m.AssertExpectations(t)
+}
+
+func TestRunPriceDrop(t *testing.T) {
+	ctx := auth.WithContext(context.TODO(), "alice", nil)
+	q, err := Post(ctx, PostQueryRequest{Query: Query{Query: "kachel", Label: "kachel Zibro"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := marktplaats.QueryRequest{Query: q.Query}
+	ad := func(price int) *marktplaats.QueryResponse {
+		return &marktplaats.QueryResponse{Advertisements: []marktplaats.Advertisement{
+			{ID: "zibro", Title: "Zibro", PriceInfo: marktplaats.PriceInfo{PriceCents: price}},
+		}}
+	}
+	m := &mpMock{}
+	s := &Service{marktplaats: m}
+	m.On("Query", mock.Anything, req).Return(ad(25000), nil).Once()
+	m.On("Query", mock.Anything, req).Return(ad(15000), nil).Twice()
+
+	_, err = s.Run(ctx, q.ID, RunParams{})
+	assert.NoError(t, err)
+	res, err := s.Run(ctx, q.ID, RunParams{})
+	assert.NoError(t, err)
+	assert.Empty(t, res.Advertisements)
+	// an unchanged price is neither a drop nor a new observation
+	_, err = s.Run(ctx, q.ID, RunParams{})
+	assert.NoError(t, err)
+
+	drops := et.Topic(PriceDropped).PublishedMessages()
+	if assert.Len(t, drops, 1) {
+		assert.Equal(t, 25000, drops[0].OldPriceCents)
+		assert.Equal(t, 15000, drops[0].NewPriceCents)
+		assert.Equal(t, 40.0, drops[0].DropPercentage)
+		assert.Equal(t, "kachel Zibro", drops[0].QueryLabel)
+	}
+
+	t.Run("price history", func(t *testing.T) {
+		h, err := GetPriceHistory(ctx, q.ID, "zibro")
+		assert.NoError(t, err)
+		assert.Equal(t, []int{25000, 15000}, lo.Map(h.Observations, func(o PriceObservation, _ int) int {
+			return o.PriceCents
+		}))
+
+		_, err = GetPriceHistory(ctx, q.ID, "unknown")
+		assert.Equal(t, errs.NotFound, errs.Code(err))
+	})
+}
+
+func TestRunAgainstFakeServer(t *testing.T) {
+	ctx := auth.WithContext(context.TODO(), "alice", nil)
+	q, err := Post(ctx, PostQueryRequest{
+		QueryURL: "https://www.marktplaats.nl/l/huis-en-inrichting/kachels/#q:zibro|f:31,32,4205|distanceMeters:50000|postcode:3461CC",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 504, q.Category)
+	assert.Equal(t, 513, q.SubCategory)
+
+	assert.Equal(t, []int{31, 32, 4205}, q.AttributesByID)
+
+	s := &Service{marktplaats: client}
+	before := len(fakeServer.SearchRequests())
+	res, err := s.Run(ctx, q.ID, RunParams{})
+	assert.NoError(t, err)
+	assert.Len(t, res.Advertisements, 2)
+	reqs := fakeServer.SearchRequests()[before:]
+	if assert.Len(t, reqs, 1) {
+		assert.Equal(t, []string{"31", "32", "4205"}, reqs[0]["attributesById[]"])
+		assert.Equal(t, "3461CC", reqs[0].Get("postcode"))
+	}
+
+	res, err = s.Run(ctx, q.ID, RunParams{})
+	assert.NoError(t, err)
+	assert.Empty(t, res.Advertisements)
+
+	t.Run("attribute ranges and attributes by key", func(t *testing.T) {
+		ranges := []marktplaats.AttributeRange{{Key: "constructionYear", From: 2010, To: 2020}}
+		byKey := []marktplaats.AttributeValue{{Key: "offeredSince", Value: "Gisteren"}}
+		q, err := Update(ctx, q.ID, UpdateQueryRequest{AttributeRanges: &ranges, AttributesByKey: &byKey})
+		assert.NoError(t, err)
+		assert.Equal(t, ranges, q.AttributeRanges)
+		assert.Equal(t, byKey, q.AttributesByKey)
+
+		_, err = s.Run(ctx, q.ID, RunParams{})
+		assert.NoError(t, err)
+		reqs := fakeServer.SearchRequests()
+		last := reqs[len(reqs)-1]
+		assert.Equal(t, []string{"constructionYear:2010:2020"}, last["attributeRanges[]"])
+		assert.Equal(t, []string{"offeredSince:Gisteren"}, last["attributesByKey[]"])
+		assert.Equal(t, []string{"31", "32", "4205"}, last["attributesById[]"])
+	})
+	t.Run("invalid attribute range", func(t *testing.T) {
+		ranges := []marktplaats.AttributeRange{{Key: "constructionYear", From: 2020, To: 2010}}
+		_, err := Update(ctx, q.ID, UpdateQueryRequest{AttributeRanges: &ranges})
+		assert.Equal(t, errs.InvalidArgument, errs.Code(err))
+	})
+}
+
+func TestHandleRunError(t *testing.T) {
+	t.Cleanup(func() { upstreamBackoff.until = time.Time{} })
+	upstream := func(kind marktplaats.ErrorKind, retryAfter time.Duration) error {
+		return &errs.Error{Code: errs.Unavailable, Details: &marktplaats.UpstreamError{Kind: kind, RetryAfter: retryAfter}}
+	}
+	assert.False(t, handleRunError("q", upstream(marktplaats.ErrUpstream, 0)))
+	assert.False(t, handleRunError("q", upstream(marktplaats.ErrSchemaChanged, 0)))
+	assert.True(t, handleRunError("q", upstream(marktplaats.ErrRateLimited, time.Minute)))
+	assert.WithinDuration(t, time.Now().Add(time.Minute), backoffUntil(), time.Second)
+	assert.True(t, handleRunError("q", upstream(marktplaats.ErrBlocked, 0)))
+	assert.WithinDuration(t, time.Now().Add(blockedBackoff), backoffUntil(), time.Second)
+}
+
+func TestSpreadOffsets(t *testing.T) {
+	offsets := spreadOffsets(3, 30*time.Second)
+	assert.Len(t, offsets, 3)
+	for i, o := range offsets {
+		assert.GreaterOrEqual(t, o, time.Duration(i)*10*time.Second)
+		assert.LessOrEqual(t, o, time.Duration(i+1)*10*time.Second)
+	}
+	assert.Equal(t, []time.Duration{0, 0}, spreadOffsets(2, 0))
+}
+
+func TestClaimQuery(t *testing.T) {
+	ctx := auth.WithContext(context.TODO(), "alice", nil)
+	q, err := Post(ctx, PostQueryRequest{Query: Query{Query: "fiets"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimed, err := claimQuery(ctx, q.ID)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	claimed, err = claimQuery(ctx, q.ID)
+	assert.NoError(t, err)
+	assert.False(t, claimed, "an overlapping run must not claim the query")
+
+	releaseQuery(ctx, q.ID)
+	claimed, err = claimQuery(ctx, q.ID)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	// an overlapping run that listed the query before it ran must not run it again
+	next := time.Now().Add(time.Hour)
+	scheduleRun(ctx, q.ID, nil, next)
+	releaseQuery(ctx, q.ID)
+	claimed, err = claimQuery(ctx, q.ID)
+	assert.NoError(t, err)
+	assert.False(t, claimed, "a query that is not due must not be claimed")
+
+	scheduleRun(ctx, q.ID, nil, time.Now().Add(-time.Minute))
+	_, err = pauseQuery(ctx, q.ID, "paused by the owner")
+	assert.NoError(t, err)
+	claimed, err = claimQuery(ctx, q.ID)
+	assert.NoError(t, err)
+	assert.False(t, claimed, "a paused query must not be claimed")
+}
+
+func TestCheckAll(t *testing.T) {
+	defer func(w time.Duration) { spreadWindow = w }(spreadWindow)
+	spreadWindow = 0
+
+	ctx := auth.WithContext(context.TODO(), "alice", nil)
+	q, err := Post(ctx, PostQueryRequest{Query: Query{Query: "zibro", CheckIntervalMinutes: 60}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := CheckAll(ctx)
+	assert.NoError(t, err)
+	assert.Zero(t, res.Failed)
+	assert.GreaterOrEqual(t, res.Succeeded, 1)
+
+	t.Run("schedules the next run", func(t *testing.T) {
+		q, err := Get(ctx, q.ID)
+		assert.NoError(t, err)
+		if assert.NotNil(t, q.LastRunAt) && assert.NotNil(t, q.NextRunAt) {
+			assert.Equal(t, q.LastRunAt.Truncate(time.Minute).Add(time.Hour), q.NextRunAt.UTC().Truncate(time.Minute))
+		}
+		requests := len(fakeServer.SearchRequests())
+		_, err = CheckAll(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, fakeServer.SearchRequests(), requests, "the query is not due yet")
+	})
+}
+
+func TestSchedule(t *testing.T) {
+	at := func(s string) time.Time {
+		t, err := time.ParseInLocation("2006-01-02 15:04", s, scheduleLocation)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	nights := Query{ActiveFromHour: 7, ActiveUntilHour: 1}
+	weekends := Query{ActiveDays: []int{int(time.Saturday), int(time.Sunday)}}
+	hourly := Query{CheckIntervalMinutes: 60}
+
+	// 2024-06-03 is a monday
+	assert.True(t, Query{}.activeAt(at("2024-06-03 03:00")))
+	assert.True(t, nights.activeAt(at("2024-06-03 00:30")))
+	assert.False(t, nights.activeAt(at("2024-06-03 03:00")))
+	assert.True(t, nights.activeAt(at("2024-06-03 07:00")))
+	assert.False(t, weekends.activeAt(at("2024-06-03 12:00")))
+	assert.True(t, weekends.activeAt(at("2024-06-02 12:00")))
+
+	assert.Equal(t, at("2024-06-03 12:01"), Query{}.nextRun(at("2024-06-03 12:00").Add(20*time.Second)))
+	assert.Equal(t, at("2024-06-03 13:00"), hourly.nextRun(at("2024-06-03 12:00")))
+	assert.Equal(t, at("2024-06-03 07:00"), nights.nextRun(at("2024-06-03 00:59")))
+	assert.Equal(t, at("2024-06-08 00:00"), weekends.nextRun(at("2024-06-03 12:00")))
+
+	assert.NoError(t, validateSchedule(nights))
+	assert.Error(t, validateSchedule(Query{ActiveUntilHour: 24}))
+	assert.Error(t, validateSchedule(Query{ActiveDays: []int{7}}))
+	assert.Error(t, validateSchedule(Query{CheckIntervalMinutes: -1}))
+}
+
+func TestPauseFailingQuery(t *testing.T) {
+	ctx := auth.WithContext(context.TODO(), "alice", nil)
+	q, err := Post(ctx, PostQueryRequest{Query: Query{Query: "verdwenen", PauseAfterFailures: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mpMock{}
+	m.On("Query", mock.Anything, mock.Anything).Return(nil, &errs.Error{Code: errs.NotFound, Message: "unknown category"})
+	s := &Service{marktplaats: m}
+
+	for i := 0; i < 2; i++ {
+		_, err := s.Run(ctx, q.ID, RunParams{})
+		assert.Error(t, err)
+		pauseIfFailing(ctx, *q, err)
+	}
+	paused, err := Get(ctx, q.ID)
+	assert.NoError(t, err)
+	assert.NotNil(t, paused.PausedAt)
+	assert.Contains(t, paused.PauseReason, "2 failed runs")
+
+	msgs := et.Topic(QueryFailing).PublishedMessages()
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, q.ID, msgs[0].QueryID)
+		assert.Equal(t, 2, msgs[0].ConsecutiveFailures)
+	}
+	due, err := getDueQueries(ctx)
+	assert.NoError(t, err)
+	assert.NotContains(t, lo.Map(due, func(q Query, _ int) string { return q.ID }), q.ID)
+
+	t.Run("resume the query", func(t *testing.T) {
+		resumed, err := Resume(ctx, q.ID)
+		assert.NoError(t, err)
+		assert.Nil(t, resumed.PausedAt)
+
+		// earlier failures no longer count
+		_, err = s.Run(ctx, q.ID, RunParams{})
+		pauseIfFailing(ctx, *q, err)
+		failures, err := consecutiveFailures(ctx, q.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, failures)
+
+		// runs that failed because marktplaats throttled all queries don't count
+		recordRun(ctx, q.ID, time.Now(), nil, &errs.Error{Code: errs.ResourceExhausted, Message: "rate limited"})
+		recordRun(ctx, q.ID, time.Now(), nil, &errs.Error{Code: errs.PermissionDenied, Message: "blocked"})
+		failures, err = consecutiveFailures(ctx, q.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, failures)
+		resumed, err = Get(ctx, q.ID)
+		assert.NoError(t, err)
+		assert.Nil(t, resumed.PausedAt)
+	})
+	t.Run("pause the query manually", func(t *testing.T) {
+		paused, err := Pause(ctx, q.ID)
+		assert.NoError(t, err)
+		assert.NotNil(t, paused.PausedAt)
+
+		_, err = Pause(auth.WithContext(context.TODO(), "bob", nil), q.ID)
+		assert.Equal(t, errs.PermissionDenied, errs.Code(err))
+	})
+}
+
+func TestStoreResultOnce(t *testing.T) {
+	ctx := auth.WithContext(context.TODO(), "alice", nil)
+	q, err := Post(ctx, PostQueryRequest{Query: Query{Query: "dubbel"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ad := marktplaats.Advertisement{ID: "m1", Title: "dubbel", URL: "https://foo.bar.com"}
+	store := func() bool {
+		tx, err := sqldb.Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inserted, err := storeResult(ctx, tx, q.ID, ad, false)
+		assert.NoError(t, err)
+		assert.NoError(t, tx.Commit())
+		return inserted
+	}
+	assert.True(t, store())
+	assert.False(t, store(), "a concurrent run must not store the advertisement again")
+}
+
+func TestFlushOutbox(t *testing.T) {
+	ctx := context.Background()
+	event := &NewQueryResultEvent{
+		QueryID:       "outbox",
+		Advertisement: marktplaats.Advertisement{ID: "m2", Title: "uitgesteld"},
+	}
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, enqueue(ctx, tx, outboxNewAds, event))
+	assert.NoError(t, tx.Commit())
+
+	// the event survives until the outbox is flushed, for example after a crash
+	assert.NoError(t, FlushOutbox(ctx))
+	published := lo.Filter(et.Topic(NewAds).PublishedMessages(), func(e *NewQueryResultEvent, _ int) bool {
+		return e.QueryID == "outbox"
+	})
+	if assert.Len(t, published, 1) {
+		assert.Equal(t, event.Advertisement.Title, published[0].Advertisement.Title)
+	}
+
+	var pending int
+	assert.NoError(t, sqldb.QueryRow(ctx, "SELECT count(*) FROM outbox").Scan(&pending))
+	assert.Zero(t, pending)
+
+	t.Run("events of unknown topics are set aside", func(t *testing.T) {
+		tx, err := sqldb.Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, enqueue(ctx, tx, "removed-topic", event))
+		// more than a batch of events is pending behind the unknown event
+		for i := 0; i < outboxBatchSize; i++ {
+			assert.NoError(t, enqueue(ctx, tx, outboxNewAds, event))
+		}
+		assert.NoError(t, tx.Commit())
+
+		assert.NoError(t, FlushOutbox(ctx))
+		var pending, dead int
+		assert.NoError(t, sqldb.QueryRow(ctx, `
+            SELECT count(*) FILTER (WHERE dead_at IS NULL), count(*) FILTER (WHERE dead_at IS NOT NULL) FROM outbox
+        `).Scan(&pending, &dead))
+		assert.Zero(t, pending)
+		assert.Equal(t, 1, dead)
+	})
+}
+
+func TestCategories(t *testing.T) {
+	ctx := auth.WithContext(context.TODO(), "alice", nil)
+
+	assert.NoError(t, RefreshCategories(ctx))
+	top, err := ListCategories(ctx, ListCategoriesParams{})
+	assert.NoError(t, err)
+	assert.Equal(t, []marktplaats.Category{
+		{ID: 504, Key: "huis-en-inrichting", Name: "Huis en Inrichting", FullName: "Huis en Inrichting"},
+	}, top.Categories)
+
+	sub, err := ListCategories(ctx, ListCategoriesParams{ParentID: 504})
+	assert.NoError(t, err)
+	if assert.Len(t, sub.Categories, 1) {
+		assert.Equal(t, "kachels", sub.Categories[0].Key)
+	}
+	_, err = ListCategories(ctx, ListCategoriesParams{ParentID: 1})
+	assert.Equal(t, errs.NotFound, errs.Code(err))
+
+	t.Run("only refresh stale categories", func(t *testing.T) {
+		count := func() int {
+			stored, err := storedCategories(ctx)
+			assert.NoError(t, err)
+			return len(stored)
+		}
+		refreshed := count()
+		_, err := sqldb.Exec(ctx, "DELETE FROM category WHERE id = 513")
+		assert.NoError(t, err)
+		assert.NoError(t, RefreshCategories(ctx))
+		assert.Equal(t, refreshed-1, count(), "recently refreshed categories are kept")
+
+		_, err = sqldb.Exec(ctx, "UPDATE category SET updated_at = now() - interval '2 days'")
+		assert.NoError(t, err)
+		assert.NoError(t, RefreshCategories(ctx))
+		assert.Equal(t, refreshed, count())
+	})
+	t.Run("use the snapshot until the categories are stored", func(t *testing.T) {
+		_, err := sqldb.Exec(ctx, "DELETE FROM category")
+		assert.NoError(t, err)
+		defer func() { assert.NoError(t, RefreshCategories(ctx)) }()
+
+		categories, err := taxonomy(ctx)
+		assert.NoError(t, err)
+		_, ok := categories.Category(513)
+		assert.True(t, ok)
+		stored, err := storedCategories(ctx)
+		assert.NoError(t, err)
+		assert.Empty(t, stored, "requests never refresh the categories")
+	})
+	t.Run("list the attributes of a category", func(t *testing.T) {
+		res, err := CategoryAttributes(ctx, 513)
+		assert.NoError(t, err)
+		keys := lo.Map(res.Attributes, func(a marktplaats.Attribute, _ int) string { return a.Key })
+		assert.Equal(t, []string{"condition", "delivery", "offeredSince"}, keys)
+
+		_, err = CategoryAttributes(ctx, 1)
+		assert.Equal(t, errs.NotFound, errs.Code(err))
+	})
+	t.Run("post a query with attributes by key", func(t *testing.T) {
+		q, err := Post(ctx, PostQueryRequest{
+			Query:      Query{Query: "zibro", Category: 504, SubCategory: 513},
+			Attributes: []string{"condition=gebruikt", "delivery=Ophalen", "offeredSince=vandaag"},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []int{32, 4205}, q.AttributesByID)
+		assert.Equal(t, []marktplaats.AttributeValue{{Key: "offeredSince", Value: "Vandaag"}}, q.AttributesByKey)
+
+		_, err = Post(ctx, PostQueryRequest{
+			Query:      Query{Query: "zibro", Category: 504, SubCategory: 513},
+			Attributes: []string{"condition"},
+		})
+		assert.Equal(t, errs.InvalidArgument, errs.Code(err))
+	})
+	t.Run("unknown categories are rejected", func(t *testing.T) {
+		_, err := Post(ctx, PostQueryRequest{QueryURL: "https://www.marktplaats.nl/l/huis-en-inrichting/banken/#q:chesterfield"})
+		assert.Equal(t, errs.InvalidArgument, errs.Code(err))
+	})
+}
+
+func TestBrowserURL(t *testing.T) {
+	ctx := auth.WithContext(context.TODO(), "carol", nil)
+	q, err := Post(ctx, PostQueryRequest{Query: Query{
+		Query: "zibro", Category: 504, SubCategory: 513, PostCode: "3461CC", DistanceMeters: 50000, PriceToCents: 15000,
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://www.marktplaats.nl/l/huis-en-inrichting/kachels/q/zibro/#PriceCentsTo:15000|distanceMeters:50000|postcode:3461CC", q.BrowserURL)
+
+	categories, err := taxonomy(ctx)
+	assert.NoError(t, err)
+	parsed, err := marktplaats.ParseURL(q.BrowserURL, categories)
+	if assert.NoError(t, err) {
+		assert.Equal(t, marktplaats.QueryRequest{
+			Query: "zibro", Category: 504, SubCategory: 513, PostCode: "3461CC", DistanceMeters: 50000, PriceToCents: 15000,
+		}, *parsed)
+	}
+
+	qs, err := List(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, qs.Queries, 1) {
+		assert.Equal(t, q.BrowserURL, qs.Queries[0].BrowserURL)
+	}
 }